@@ -1,267 +1,17 @@
 package main
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"time"
 
-	"github.com/BurntSushi/toml"
+	"github.com/rubberydub/many/pkg/many"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-// A version of a service.
-type Version struct {
-	Name        string
-	Description string
-	Date        time.Time
-	Author      string
-}
-
-// A collection of versions.
-type Versions []Version
-
-// A service.
-type Service struct {
-	Name        string
-	Description string
-	Git         string
-	Docker      string
-	Candidate   Version
-	Versions    Versions
-}
-
-// A table of services. The key is the service's name.
-type Services map[string]Service
-
-// The Manyfile is the TOML config containing the versioning information.
-type Manyfile struct {
-	Name       string   `toml:"name"`
-	RemoteURL  string   `toml:"remote_url"`
-	RemoteName string   `toml:"remote_name"`
-	Versions   Versions `toml:"versions"`
-	Services   Services `toml:"services"`
-}
-
-// A Many repository.
-type Repo struct {
-	Path     string
-	File     string
-	ManyFile Manyfile
-}
-
-// Part of the sort interface.
-func (vs Versions) Len() int {
-	return len(vs)
-}
-
-// Part of the sort interface.
-func (vs Versions) Swap(i, j int) {
-	vs[i], vs[j] = vs[j], vs[i]
-}
-
-// Part of the sort interface.
-func (vs Versions) Less(i, j int) bool {
-	return vs[i].Name < vs[j].Name
-}
-
-// Add a version to a collection of versions.
-func (vs Versions) Add(v Version) {
-	// Sort the versions and search for the version to be added.
-	sort.Sort(vs)
-	i := sort.Search(len(vs), func(i int) bool { return vs[i].Name >= v.Name })
-	// The version already exists in the collection.
-	if i < len(vs) && vs[i] == v {
-		// Override the version.
-		vs[i] = v
-		// The version does not exist in the collection.
-	} else {
-		// Insert the version.
-		vs = append(vs, Version{})
-		copy(vs[i+1:], vs[i:])
-		vs[i] = v
-	}
-}
-
-// Merge services.
-func (s1 *Service) Merge(s2 Service) error {
-	if s2.Name != "" {
-		s1.Name = s2.Name
-	}
-	if s2.Description != "" {
-		s1.Description = s2.Description
-	}
-	if s2.Git != "" {
-		s1.Git = s2.Git
-	}
-	if s2.Docker != "" {
-		s1.Docker = s2.Docker
-	}
-	if s2.Candidate != (Version{}) {
-		s1.Candidate = s2.Candidate
-	}
-	if s2.Versions != nil {
-		for _, v := range s2.Versions {
-			s1.Versions.Add(v)
-		}
-	}
-	return nil
-}
-
-// Merge Manyfiles.
-func (f1 *Manyfile) Merge(f2 Manyfile) error {
-	if f2.Name != "" {
-		f1.Name = f2.Name
-	}
-	if f2.RemoteURL != "" {
-		f1.RemoteURL = f2.RemoteURL
-	}
-	if f2.RemoteName != "" {
-		f1.RemoteName = f2.RemoteName
-	}
-	if f2.Versions != nil {
-		for _, f := range f2.Versions {
-			f1.Versions.Add(f)
-		}
-	}
-	if f2.Services != nil {
-		for n, s2 := range f2.Services {
-			s1, ok := f1.Services[n]
-			if ok {
-				s1.Merge(s2)
-			}
-		}
-	}
-	return nil
-}
-
-// Save the repo.
-func (r *Repo) Save() error {
-	// Check if the repo dir exists.
-	_, err := os.Stat(r.Path)
-	if err != nil {
-		// The repo dir exists and there was an error.
-		if !os.IsNotExist(err) {
-			return err
-		}
-		// Repo dir doesn't exist. Make the repo dir.
-		err = os.MkdirAll(r.Path, 700)
-		if err != nil {
-			return err
-		}
-	}
-	// Check if the Manyfile exists.
-	_, err = os.Stat(r.File)
-	// The Manyfile exists and there was an error.
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	// Create the Manyfile. If it already exists it will be truncated.
-	f, err := os.Create(r.File)
-	defer f.Close()
-	if err != nil {
-		return err
-	}
-	// Write the Manyfile.
-	e := toml.NewEncoder(f)
-	err = e.Encode(r.ManyFile)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Load the repo.
-func LoadRepo(repo string, file string) (*Repo, error) {
-	// Clean the repo path.
-	repo = filepath.Clean(repo)
-	// Create a path from the repo path and the file path.
-	file = filepath.Join(repo, file)
-	// Check if the repo dir exists.
-	_, err := os.Stat(repo)
-	if err != nil {
-		return nil, err
-	}
-	// Check if the repo file exists.
-	_, err = os.Stat(file)
-	if err != nil {
-		return nil, err
-	}
-	// Decode the repo's Manyfile.
-	var m *Manyfile
-	_, err = toml.DecodeFile(file, m)
-	if err != nil {
-		return nil, err
-	}
-	// Return a new repo struct.
-	return &Repo{
-		Path:     repo,
-		File:     file,
-		ManyFile: *m,
-	}, nil
-}
-
-// Initialise the repo.
-func InitRepo(
-	repo string,
-	file string,
-	name string,
-	remoteURL string,
-	remoteName string,
-	update bool,
-	noClone bool,
-) error {
-	// Attempt to load an existing repo.
-	r, err := LoadRepo(repo, file)
-	if err != nil {
-		// Repo exists and there was an error loading it.
-		if !os.IsNotExist(err) {
-			return err
-		}
-		// TODO clone.
-		// Repo does not exist. Create it.
-		r = &Repo{
-			Path:     repo,
-			File:     file,
-			ManyFile: Manyfile{
-				Name:       name,
-				RemoteURL:  remoteURL,
-				RemoteName: remoteName,
-				Versions:   Versions{},
-				Services:   Services{},
-			},
-		}
-		err = r.Save()
-		if err != nil {
-			return err
-		}
-		return nil
-	}
-	// Repo exists, update it if flagged.
-	if !update {
-		return errors.New("Repository already exists. Use --update to update it.")
-	}
-	// Update the repo. Merge in the new repo details.
-	err = r.ManyFile.Merge(
-		Manyfile{
-			Name:       name,
-			RemoteURL:  remoteURL,
-			RemoteName: remoteName,
-		},
-	)
-	if err != nil {
-		return err
-	}
-	// Save the updated repo.
-	err = r.Save()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func main() {
 	var (
 		// The application's version.
@@ -277,8 +27,32 @@ func main() {
 		).Short('r').Default(".").String()
 		argFile = a.Flag(
 			"file",
-			"Name of the Many file.",
-		).Short('f').Default("Many.toml").String()
+			"Name of the Many file. The format is chosen by the extension: "+
+				".toml, .yaml, .yml or .json. Defaults to the existing Many file, "+
+				"or Many.toml.",
+		).Short('f').String()
+		argLockTimeout = a.Flag(
+			"lock-timeout",
+			"How long to wait for another invocation to release the repository.",
+		).Default("30s").Duration()
+		argRegistryUsername = a.Flag(
+			"registry-username",
+			"Username for Docker registries.",
+		).Envar("MANY_REGISTRY_USERNAME").String()
+		argRegistryPassword = a.Flag(
+			"registry-password",
+			"Password or token for Docker registries.",
+		).Envar("MANY_REGISTRY_PASSWORD").String()
+		argInsecureRegistries = a.Flag(
+			"insecure-registry",
+			"Docker registry to reach over plain HTTP, as host:port. Registries "+
+				"on localhost always are. Repeatable.",
+		).Strings()
+		argMirrors = a.Flag(
+			"mirrors",
+			"Directory for mirrors of the services' git repositories. Defaults "+
+				"to the user's cache directory.",
+		).String()
 		argInit = a.Command(
 			"init",
 			"Initialize a new Many repository with an empty versioning file. "+
@@ -304,46 +78,76 @@ func main() {
 			"no-clone",
 			"Do not clone the from an existing repository at the remote URL.",
 		).Short('n').Default("false").Bool()
-		// argPull = a.Command(
-		// 	"pull",
-		// 	"Pull changes from the remote Many repository.",
-		// )
-		// argPush = a.Command(
-		// 	"push",
-		// 	"Push changes to the remote Many Grepository.",
-		// )
-		// argCreate = a.Command(
-		// 	"create",
-		// 	"Register a new service with Many.",
-		// )
-		// argCreateUpdate = argCreate.Flag(
-		// 	"update",
-		// 	"Update service details if it already exists.",
-		// ).Short('u').Default("false").Bool()
-		// argCreateName = argCreate.Arg(
-		// 	"service",
-		// 	"Name of service.",
-		// ).Required().String()
-		// argCreateDescription = argCreate.Flag(
-		// 	"description",
-		// 	"Description of service.",
-		// ).Short('s').String()
-		// argCreateGit = argCreate.Flag(
-		// 	"git",
-		// 	"URL of the Git repository for the service.",
-		// ).Short('g').String()
-		// argCreateDocker = argCreate.Flag(
-		// 	"docker",
-		// 	"URL of the Docker repository for the service.",
-		// ).Short('c').URL()
-		// argView = a.Command(
-		// 	"view",
-		// 	"View details for services.",
-		// )
-		// argViewName = argView.Arg(
-		// 	"services",
-		// 	"CSV list of services.",
-		// ).Required().String()
+		_ = a.Command(
+			"pull",
+			"Pull changes from the remote Many repository.",
+		)
+		argPush = a.Command(
+			"push",
+			"Commit changes to the Manyfile and push them to the remote Many "+
+				"repository.",
+		)
+		argPushMessage = argPush.Flag(
+			"message",
+			"Commit message. Generated from the changes if not provided.",
+		).Short('m').String()
+		argMergeDriver = a.Command(
+			"merge-driver",
+			"Merge three versions of a Manyfile, writing the result over ours. "+
+				"For use as a git merge driver.",
+		)
+		argMergeDriverBase = argMergeDriver.Arg(
+			"base",
+			"The common ancestor's Manyfile.",
+		).Required().ExistingFile()
+		argMergeDriverOurs = argMergeDriver.Arg(
+			"ours",
+			"Our Manyfile.",
+		).Required().ExistingFile()
+		argMergeDriverTheirs = argMergeDriver.Arg(
+			"theirs",
+			"Their Manyfile.",
+		).Required().ExistingFile()
+		argCreate = a.Command(
+			"create",
+			"Register a new service with Many.",
+		)
+		argCreateUpdate = argCreate.Flag(
+			"update",
+			"Update service details if it already exists.",
+		).Short('u').Default("false").Bool()
+		argCreateName = argCreate.Arg(
+			"service",
+			"Name of service.",
+		).Required().String()
+		argCreateDescription = argCreate.Flag(
+			"description",
+			"Description of service.",
+		).Short('s').String()
+		argCreateGit = argCreate.Flag(
+			"git",
+			"URL of the Git repository for the service.",
+		).Short('g').String()
+		argCreateDocker = argCreate.Flag(
+			"docker",
+			"Docker repository for the service, without a tag.",
+		).Short('c').String()
+		argView = a.Command(
+			"view",
+			"View details for services.",
+		)
+		argViewName = argView.Arg(
+			"services",
+			"CSV list of services.",
+		).Required().String()
+		argViewOutput = argView.Flag(
+			"output",
+			"Output format.",
+		).Short('o').Default(OutputTable).Enum(OutputTable, OutputJSON, OutputYAML)
+		argViewLimit = argView.Flag(
+			"limit",
+			"Number of recent versions to show. Zero shows all versions.",
+		).Short('l').Default("5").Int()
 		// argDelete = a.Command(
 		// 	"delete",
 		// 	"Delete a service.",
@@ -352,93 +156,944 @@ func main() {
 		// 	"service",
 		// 	"Name of service.",
 		// ).Required().String()
-		// argPromote = a.Command(
-		// 	"promote",
-		// 	"Promote a candidate version of a service.",
-		// )
-		// argPromoteName = argPromote.Arg(
-		// 	"service",
-		// 	"Name of service.",
-		// ).Required().String()
-		// argPromoteVersion = argPromote.Arg(
-		// 	"version",
-		// 	"Candidate version.",
-		// ).Required().String()
-		// argCurrent = a.Command(
-		// 	"current",
-		// 	"View the current overall version.",
-		// )
-		// argRelease = a.Command(
-		// 	"release",
-		// 	"Create a new overall version from the candidates.",
-		// )
-		// argReleaseCategory = argRelease.Arg(
-		// 	"version",
-		// 	"Version to increment for this release.",
-		// ).Required().Enum("patch", "minor", "major")
+		argCandidate = a.Command(
+			"candidate",
+			"Set the candidate version of a service. Safe to repeat.",
+		)
+		argCandidateName = argCandidate.Arg(
+			"service",
+			"Name of service.",
+		).Required().String()
+		argCandidateVersion = argCandidate.Arg(
+			"version",
+			"Candidate version. Defaults to the commit being built in CI.",
+		).String()
+		argCandidateBuildNumber = argCandidate.Flag(
+			"build-number",
+			"Default to the CI build number instead of the commit.",
+		).Default("false").Bool()
+		argCandidateDescription = argCandidate.Flag(
+			"description",
+			"Description of the candidate. Defaults to the commit's subject.",
+		).Short('s').String()
+		argCandidateAuthor = argCandidate.Flag(
+			"author",
+			"Author of the candidate. Defaults to the CI user, or the git user.",
+		).Short('a').String()
+		argPromote = a.Command(
+			"promote",
+			"Promote a candidate version of a service.",
+		)
+		argPromoteName = argPromote.Arg(
+			"service",
+			"Name of service.",
+		).Required().String()
+		argPromoteVersion = argPromote.Arg(
+			"version",
+			"Candidate version.",
+		).Required().String()
+		argPromoteKeep = argPromote.Flag(
+			"keep-candidate",
+			"Keep the candidate after promoting it.",
+		).Short('k').Default("false").Bool()
+		argPromoteAuthor = argPromote.Flag(
+			"author",
+			"Author of the promotion. Defaults to the git user.",
+		).Short('a').String()
+		argPromoteGitTag = argPromote.Flag(
+			"git-tag",
+			"Tag the version's commit in the service's git repository and push "+
+				"the tag.",
+		).Default("false").Bool()
+		argPromoteTagTemplate = argPromote.Flag(
+			"tag-template",
+			"Template of the git tag's name. Fields: .Name, .Service, .Version.",
+		).Default(many.DefaultPromoteTagTemplate).String()
+		argPromoteSign = argPromote.Flag(
+			"sign",
+			"Sign the git tag.",
+		).Default("false").Bool()
+		argPromoteDryRun = argPromote.Flag(
+			"dry-run",
+			"Show what would be done without changing anything.",
+		).Short('n').Default("false").Bool()
+		argCurrent = a.Command(
+			"current",
+			"View the current overall version.",
+		)
+		argCurrentShort = argCurrent.Flag(
+			"short",
+			"Print only the version.",
+		).Default("false").Bool()
+		argCurrentOutput = argCurrent.Flag(
+			"output",
+			"Output format.",
+		).Short('o').Default(OutputTable).Enum(OutputTable, OutputJSON, OutputYAML)
+		argDiff = a.Command(
+			"diff",
+			"Compare the services of two overall versions.",
+		)
+		argDiffFrom = argDiff.Arg(
+			"from",
+			"Overall version to compare from.",
+		).Required().String()
+		argDiffTo = argDiff.Arg(
+			"to",
+			"Overall version to compare to. Defaults to the current version.",
+		).String()
+		argDiffOutput = argDiff.Flag(
+			"output",
+			"Output format.",
+		).Short('o').Default(OutputTable).Enum(
+			OutputTable,
+			OutputJSON,
+			OutputYAML,
+			OutputMarkdown,
+		)
+		argChangelog = a.Command(
+			"changelog",
+			"List the commits to each service between two overall versions.",
+		)
+		argChangelogFrom = argChangelog.Arg(
+			"from",
+			"Overall version to list changes from.",
+		).Required().String()
+		argChangelogTo = argChangelog.Arg(
+			"to",
+			"Overall version to list changes to. Defaults to the current version.",
+		).String()
+		argChangelogGroup = argChangelog.Flag(
+			"group",
+			"Group commits by conventional commit type.",
+		).Short('g').Default("false").Bool()
+		argChangelogOutput = argChangelog.Flag(
+			"output",
+			"Output format.",
+		).Short('o').Default(OutputMarkdown).Enum(OutputMarkdown, OutputJSON, OutputYAML)
+		argNotes = a.Command(
+			"notes",
+			"Render the release notes of an overall version.",
+		)
+		argNotesVersion = argNotes.Arg(
+			"version",
+			"Overall version. Defaults to the current version.",
+		).String()
+		argNotesTemplate = argNotes.Flag(
+			"template",
+			"Template file, relative to the Many repository. Defaults to "+
+				many.NotesTemplateFile+" if it exists, otherwise markdown.",
+		).Short('t').String()
+		argRelease = a.Command(
+			"release",
+			"Create a new overall version from the latest version of each "+
+				"service.",
+		)
+		argReleaseCategory = argRelease.Arg(
+			"version",
+			"Version to increment for this release.",
+		).Required().Enum(many.BumpPatch, many.BumpMinor, many.BumpMajor)
+		argReleaseDescription = argRelease.Flag(
+			"description",
+			"Description of the release.",
+		).Short('s').String()
+		argReleaseAuthor = argRelease.Flag(
+			"author",
+			"Author of the release. Defaults to the git user.",
+		).Short('a').String()
+		argReleaseVerify = argRelease.Flag(
+			"verify",
+			"Check the services' Docker images exist before releasing. Use "+
+				"--no-verify to skip.",
+		).Default("true").Bool()
+		argReleaseGitTags = argRelease.Flag(
+			"git-tags",
+			"Tag the commit of each service's version in its git repository "+
+				"and push the tags.",
+		).Default("false").Bool()
+		argReleaseTagTemplate = argRelease.Flag(
+			"tag-template",
+			"Template of the git tags' names. Fields: .Name, .Release, "+
+				".Service, .Version.",
+		).Default(many.DefaultReleaseTagTemplate).String()
+		argReleaseSign = argRelease.Flag(
+			"sign",
+			"Sign the git tags.",
+		).Default("false").Bool()
+		argReleaseDryRun = argRelease.Flag(
+			"dry-run",
+			"Show what would be done without changing anything.",
+		).Short('n').Default("false").Bool()
+		argReleaseIncompatible = argRelease.Flag(
+			"incompatible",
+			"Mark the release as one that can't be rolled back past, for "+
+				"example because it migrates a database.",
+		).Default("false").Bool()
+		argVerify = a.Command(
+			"verify",
+			"Check the services' Docker images exist and record their digests.",
+		)
+		argVerifyName = argVerify.Arg(
+			"services",
+			"Comma separated services. Defaults to all services.",
+		).String()
+		argVerifyCandidates = argVerify.Flag(
+			"candidates",
+			"Check the candidates instead of the latest versions.",
+		).Default("false").Bool()
+		argVerifyOutput = argVerify.Flag(
+			"output",
+			"Output format.",
+		).Short('o').Default(OutputTable).Enum(OutputTable, OutputJSON, OutputYAML)
+		argTagImages = a.Command(
+			"tag-images",
+			"Tag the Docker images of an overall version's services with the "+
+				"overall version.",
+		)
+		argTagImagesVersion = argTagImages.Arg(
+			"version",
+			"Overall version. Defaults to the current version.",
+		).String()
+		argTagImagesForce = argTagImages.Flag(
+			"force",
+			"Move tags that point at other images.",
+		).Default("false").Bool()
+		argTagImagesOutput = argTagImages.Flag(
+			"output",
+			"Output format.",
+		).Short('o').Default(OutputTable).Enum(OutputTable, OutputJSON, OutputYAML)
+		argDeploy = a.Command(
+			"deploy",
+			"Record the deployment of an overall version to an environment.",
+		)
+		argDeployEnv = argDeploy.Arg(
+			"env",
+			"Name of environment.",
+		).Required().String()
+		argDeployVersion = argDeploy.Arg(
+			"version",
+			"Overall version. Defaults to the current version.",
+		).String()
+		argDeployAuthor = argDeploy.Flag(
+			"author",
+			"Who deployed. Defaults to the git user.",
+		).Short('a').String()
+		argEnv = a.Command(
+			"env",
+			"Manage environments.",
+		)
+		argEnvAdd = argEnv.Command(
+			"add",
+			"Add an environment that overall versions are deployed to.",
+		)
+		argEnvAddName = argEnvAdd.Arg(
+			"env",
+			"Name of environment.",
+		).Required().String()
+		argEnvAddDescription = argEnvAdd.Flag(
+			"description",
+			"Description of environment.",
+		).Short('s').String()
+		argEnvAddUpdate = argEnvAdd.Flag(
+			"update",
+			"Update environment details if it already exists.",
+		).Short('u').Default("false").Bool()
+		argEnvStatus = argEnv.Command(
+			"status",
+			"Show the versions deployed in environments.",
+		)
+		argEnvStatusName = argEnvStatus.Arg(
+			"envs",
+			"CSV list of environments. Defaults to all environments.",
+		).String()
+		argEnvStatusAt = argEnvStatus.Flag(
+			"at",
+			"Show the versions deployed at a time instead of now. RFC 3339, "+
+				"or YYYY-MM-DD for the end of a day.",
+		).String()
+		argEnvStatusOutput = argEnvStatus.Flag(
+			"output",
+			"Output format.",
+		).Short('o').Default(OutputTable).Enum(OutputTable, OutputJSON, OutputYAML)
+		argEnvHistory = argEnv.Command(
+			"history",
+			"List the deployments to an environment, newest first.",
+		)
+		argEnvHistoryName = argEnvHistory.Arg(
+			"env",
+			"Name of environment.",
+		).Required().String()
+		argEnvHistoryOutput = argEnvHistory.Flag(
+			"output",
+			"Output format.",
+		).Short('o').Default(OutputTable).Enum(OutputTable, OutputJSON, OutputYAML)
+		argRollback = a.Command(
+			"rollback",
+			"Return the product or an environment to an earlier overall version.",
+		)
+		argRollbackVersion = argRollback.Arg(
+			"version",
+			"Overall version to roll back to. Defaults to the previous release.",
+		).String()
+		argRollbackEnv = argRollback.Flag(
+			"env",
+			"Roll back an environment instead of the product.",
+		).Short('e').String()
+		argRollbackAuthor = argRollback.Flag(
+			"author",
+			"Who rolled back an environment. Defaults to the git user.",
+		).Short('a').String()
+		argRollbackDryRun = argRollback.Flag(
+			"dry-run",
+			"Show what would change without changing anything.",
+		).Short('n').Default("false").Bool()
+		argMigrate = a.Command(
+			"migrate",
+			"Upgrade the Manyfile to the current schema version.",
+		)
+		argMigrateDryRun = argMigrate.Flag(
+			"dry-run",
+			"Print the changes instead of saving them.",
+		).Short('n').Default("false").Bool()
+		argConvert = a.Command(
+			"convert",
+			"Convert the Manyfile to another format.",
+		)
+		argConvertTo = argConvert.Flag(
+			"to",
+			"Format to convert to.",
+		).Short('t').Required().Enum(many.Formats()...)
+		argLint = a.Command(
+			"lint",
+			"Check the Manyfile for problems. Exits non-zero if there are errors.",
+		)
+		argLintFix = argLint.Flag(
+			"fix",
+			"Fix problems that can be fixed safely.",
+		).Default("false").Bool()
 	)
 	// Kingpin.
 	a.HelpFlag.Short('h')
 	a.Version(version)
 	a.VersionFlag.Short('v')
 	c := kingpin.MustParse(a.Parse(os.Args[1:]))
+	// Find the Many file if it wasn't given.
+	if *argFile == "" {
+		*argFile = many.FindManyfile(*argRepo)
+	}
+	// Mirrors of the services' git repositories.
+	if *argMirrors == "" {
+		d, err := many.DefaultMirrorDir()
+		if err == nil {
+			*argMirrors = d
+		}
+	}
+	// Docker registries.
+	reg := &many.Registry{
+		Username: *argRegistryUsername,
+		Password: *argRegistryPassword,
+		Insecure: *argInsecureRegistries,
+	}
 	// Loggers. No prefix. No timestamps.
 	lstdout := log.New(os.Stdout, "", 0)
 	lstderr := log.New(os.Stderr, "", 0)
 	// Switch on command.
 	switch c {
 	case "init":
-		err := InitRepo(
-			*argRepo,
-			*argFile,
-			*argInitName,
-			*argInitRemoteURL,
-			*argInitRemoteName,
-			*argInitUpdate,
-			*argInitNoClone,
+		var res many.InitResult
+		err := many.WithLock(*argRepo, *argLockTimeout, func() error {
+			var err error
+			res, err = many.InitRepo(
+				*argRepo,
+				*argFile,
+				*argInitName,
+				*argInitRemoteURL,
+				*argInitRemoteName,
+				*argInitUpdate,
+				*argInitNoClone,
+			)
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		switch res {
+		case many.InitCreated:
+			lstdout.Println("Initialised new Many repo.")
+		case many.InitCloned:
+			lstdout.Printf("Cloned Many repo from %s.\n", *argInitRemoteURL)
+		case many.InitUpdated:
+			lstdout.Println("Updated Many repo.")
+		}
+	case "pull":
+		var res many.SyncResult
+		err := many.WithLock(*argRepo, *argLockTimeout, func() error {
+			r, err := many.LoadRepo(*argRepo, *argFile)
+			if err != nil {
+				return err
+			}
+			res, err = r.Pull()
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		switch res {
+		case many.SyncUpToDate:
+			lstdout.Println("Already up to date.")
+		case many.SyncFastForwarded:
+			lstdout.Println("Pulled Many repo.")
+		case many.SyncMerged:
+			lstdout.Println("Merged remote changes into Many repo.")
+		}
+	case "push":
+		var res many.SyncResult
+		err := many.WithLock(*argRepo, *argLockTimeout, func() error {
+			r, err := many.LoadRepo(*argRepo, *argFile)
+			if err != nil {
+				return err
+			}
+			res, err = r.Push(*argPushMessage)
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		switch res {
+		case many.SyncUpToDate:
+			lstdout.Println("Nothing to push.")
+		case many.SyncPushed:
+			lstdout.Println("Pushed Many repo.")
+		}
+	case "merge-driver":
+		err := many.MergeFiles(
+			*argMergeDriverBase,
+			*argMergeDriverOurs,
+			*argMergeDriverTheirs,
 		)
 		if err != nil {
 			lstderr.Fatal(err)
 		}
-		lstdout.Println("Initialised Many repo.")
-		// case "pull":
-		// 	lstdout.Println("Pulling Many repo.")
-		// 	// TODO
-		// 	if err != nil {
-		// 		lstderr.Fatal(err)
-		// 	}
-		// 	lstdout.Println("Success.")
-		// case "push":
-		// 	lstdout.Println("Pushing Many repo.")
-		// 	// TODO
-		// 	if err != nil {
-		// 		lstderr.Fatal(err)
-		// 	}
-		// 	lstdout.Println("Success.")
-		// case "register":
-		// 	// TODO
-		// 	if err != nil {
-		// 		lstderr.Fatal(err)
-		// 	}
-		// 	lstdout.Println("Registered service.")
-		// case "view":
+	case "create":
+		var created bool
+		_, err := many.UpdateRepo(*argRepo, *argFile, *argLockTimeout, func(m *many.Manyfile) error {
+			var err error
+			created, err = m.CreateService(
+				many.Service{
+					Name:        *argCreateName,
+					Description: *argCreateDescription,
+					Git:         *argCreateGit,
+					Docker:      *argCreateDocker,
+					Versions:    many.Versions{},
+				},
+				*argCreateUpdate,
+			)
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		if created {
+			lstdout.Println("Registered service.")
+		} else {
+			lstdout.Println("Updated service.")
+		}
+	case "view":
+		r, err := many.LoadRepo(*argRepo, *argFile)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		svs, err := r.ManyFile.ViewServices(splitNames(*argViewName), *argViewLimit)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		err = writeServices(os.Stdout, *argViewOutput, svs)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
 		// case "delete":
 		// 	// TODO
 		// 	if err != nil {
 		// 		lstderr.Fatal(err)
 		// 	}
 		// 	lstdout.Println("Deleted service.")
-		// case "promote":
-		// 	// TODO
-		// 	if err != nil {
-		// 		lstderr.Fatal(err)
-		// 	}
-		// 	lstdout.Println("Promoted service.")
-		// case "increment":
-		// 	// TODO
-		// 	if err != nil {
-		// 		lstderr.Fatal(err)
-		// 	}
-		// 	lstdout.Println("Incremented service.")
+	case "candidate":
+		// Fill in what isn't given from the CI build.
+		b := many.CIBuildFromEnv(os.Getenv)
+		cand := many.Version{
+			Name:        *argCandidateVersion,
+			Description: *argCandidateDescription,
+			Date:        b.Date,
+			Author:      *argCandidateAuthor,
+		}
+		if cand.Name == "" {
+			cand.Name = b.Commit
+			if *argCandidateBuildNumber {
+				cand.Name = b.Number
+			}
+		}
+		if cand.Name == "" {
+			lstderr.Fatal("No version given and none found in CI variables.")
+		}
+		if cand.Description == "" {
+			cand.Description = b.Subject
+		}
+		if cand.Description == "" && b.Commit != "" {
+			cand.Description = many.CommitSubject(".", b.Commit)
+		}
+		if cand.Author == "" {
+			cand.Author = b.Actor
+		}
+		if cand.Author == "" {
+			cand.Author = many.DefaultAuthor(*argRepo)
+		}
+		if cand.Date.IsZero() {
+			cand.Date = time.Now().UTC()
+		}
+		var res many.CandidateResult
+		_, err := many.UpdateRepo(*argRepo, *argFile, *argLockTimeout, func(m *many.Manyfile) error {
+			var err error
+			res, err = m.SetCandidate(*argCandidateName, cand)
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		switch res {
+		case many.CandidateSet:
+			lstdout.Printf("Set candidate of %s to %s.\n", *argCandidateName, cand.Name)
+		case many.CandidateUnchanged:
+			lstdout.Printf("Candidate of %s is already %s.\n", *argCandidateName, cand.Name)
+		case many.CandidatePromoted:
+			lstdout.Printf("Version %s of %s is already promoted.\n", cand.Name, *argCandidateName)
+		}
+	case "promote":
+		author := *argPromoteAuthor
+		if author == "" {
+			author = many.DefaultAuthor(*argRepo)
+		}
+		var promoted bool
+		var tags []many.GitTag
+		err := updateRepo(*argRepo, *argFile, *argLockTimeout, *argPromoteDryRun, func(m *many.Manyfile) error {
+			var err error
+			promoted, err = m.Promote(
+				*argPromoteName,
+				*argPromoteVersion,
+				author,
+				time.Now().UTC(),
+				*argPromoteKeep,
+			)
+			if err != nil || !*argPromoteGitTag {
+				return err
+			}
+			tags, err = m.TagServiceRepo(
+				*argPromoteName,
+				*argPromoteVersion,
+				many.GitTagOptions{
+					Template: *argPromoteTagTemplate,
+					Sign:     *argPromoteSign,
+					DryRun:   *argPromoteDryRun,
+					Mirrors:  *argMirrors,
+				},
+			)
+			return err
+		})
+		if err != nil {
+			// Tags are only set once they are pushed, so the promotion
+			// wasn't saved and they must go.
+			lstderr.Fatal(many.RollbackGitTags(tags, err))
+		}
+		switch {
+		case *argPromoteDryRun:
+			lstdout.Printf("Would promote %s.\n", *argPromoteVersion)
+		case promoted:
+			lstdout.Println("Promoted service.")
+		default:
+			lstdout.Println("Version already promoted.")
+		}
+		writeGitTags(os.Stdout, tags)
+	case "current":
+		r, err := many.LoadRepo(*argRepo, *argFile)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		v, err := r.ManyFile.Current()
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		if *argCurrentShort {
+			lstdout.Println(v.Name)
+			break
+		}
+		err = writeRelease(os.Stdout, *argCurrentOutput, many.NewVersionView(v))
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+	case "diff":
+		r, err := many.LoadRepo(*argRepo, *argFile)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		to := *argDiffTo
+		if to == "" {
+			v, err := r.ManyFile.Current()
+			if err != nil {
+				lstderr.Fatal(err)
+			}
+			to = v.Name
+		}
+		d, err := r.ManyFile.DiffReleases(*argDiffFrom, to)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		err = writeDiff(os.Stdout, *argDiffOutput, d)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+	case "changelog":
+		r, err := many.LoadRepo(*argRepo, *argFile)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		to := *argChangelogTo
+		if to == "" {
+			v, err := r.ManyFile.Current()
+			if err != nil {
+				lstderr.Fatal(err)
+			}
+			to = v.Name
+		}
+		cl, err := r.ManyFile.Changelog(*argChangelogFrom, to, *argMirrors)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		err = writeChangelog(os.Stdout, *argChangelogOutput, cl, *argChangelogGroup)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+	case "notes":
+		r, err := many.LoadRepo(*argRepo, *argFile)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		version := *argNotesVersion
+		if version == "" {
+			v, err := r.ManyFile.Current()
+			if err != nil {
+				lstderr.Fatal(err)
+			}
+			version = v.Name
+		}
+		tmpl, err := r.NotesTemplate(*argNotesTemplate)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		n, err := r.ManyFile.Notes(version)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		err = many.RenderNotes(os.Stdout, tmpl, n)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+	case "release":
+		author := *argReleaseAuthor
+		if author == "" {
+			author = many.DefaultAuthor(*argRepo)
+		}
+		var v many.Version
+		var tags []many.GitTag
+		err := updateRepo(*argRepo, *argFile, *argLockTimeout, *argReleaseDryRun, func(m *many.Manyfile) error {
+			if *argReleaseVerify {
+				_, err := m.VerifyImages(reg, nil, false)
+				if err != nil {
+					return err
+				}
+			}
+			var err error
+			v, err = m.Release(
+				*argReleaseCategory,
+				*argReleaseDescription,
+				author,
+				time.Now().UTC(),
+				*argReleaseIncompatible,
+			)
+			if err != nil || !*argReleaseGitTags {
+				return err
+			}
+			tags, err = m.TagReleaseRepos(
+				v.Name,
+				many.GitTagOptions{
+					Template: *argReleaseTagTemplate,
+					Sign:     *argReleaseSign,
+					DryRun:   *argReleaseDryRun,
+					Mirrors:  *argMirrors,
+				},
+			)
+			return err
+		})
+		if err != nil {
+			// Tags are only set once they are pushed, so the release wasn't
+			// saved and they must go.
+			lstderr.Fatal(many.RollbackGitTags(tags, err))
+		}
+		if *argReleaseDryRun {
+			lstdout.Printf("Would release %s.\n", v.Name)
+		} else {
+			lstdout.Printf("Released %s.\n", v.Name)
+		}
+		writeGitTags(os.Stdout, tags)
+	case "verify":
+		var checks []many.ImageCheck
+		var verr error
+		_, err := many.UpdateRepo(*argRepo, *argFile, *argLockTimeout, func(m *many.Manyfile) error {
+			// Record the digests that were found even if some images are
+			// missing. Other errors, such as an unreachable registry, come
+			// without checks.
+			checks, verr = m.VerifyImages(reg, splitNames(*argVerifyName), *argVerifyCandidates)
+			if checks == nil {
+				return verr
+			}
+			return nil
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		err = writeChecks(os.Stdout, *argVerifyOutput, checks)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		if verr != nil {
+			lstderr.Fatal(verr)
+		}
+	case "tag-images":
+		r, err := many.LoadRepo(*argRepo, *argFile)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		version := *argTagImagesVersion
+		if version == "" {
+			v, err := r.ManyFile.Current()
+			if err != nil {
+				lstderr.Fatal(err)
+			}
+			version = v.Name
+		}
+		rs, terr := r.ManyFile.TagImages(reg, version, *argTagImagesForce)
+		if rs == nil {
+			lstderr.Fatal(terr)
+		}
+		err = writeTags(os.Stdout, *argTagImagesOutput, rs)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		if terr != nil {
+			lstderr.Fatal(terr)
+		}
+	case "deploy":
+		author := *argDeployAuthor
+		if author == "" {
+			author = many.DefaultAuthor(*argRepo)
+		}
+		var d many.Deployment
+		_, err := many.UpdateRepo(*argRepo, *argFile, *argLockTimeout, func(m *many.Manyfile) error {
+			version := *argDeployVersion
+			if version == "" {
+				v, err := m.Current()
+				if err != nil {
+					return err
+				}
+				version = v.Name
+			}
+			var err error
+			d, err = m.Deploy(*argDeployEnv, version, author, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		lstdout.Printf("Deployed %s to %s.\n", d.Release, *argDeployEnv)
+	case "env add":
+		var added bool
+		_, err := many.UpdateRepo(*argRepo, *argFile, *argLockTimeout, func(m *many.Manyfile) error {
+			var err error
+			added, err = m.AddEnvironment(*argEnvAddName, *argEnvAddDescription, *argEnvAddUpdate)
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		if added {
+			lstdout.Println("Added environment.")
+		} else {
+			lstdout.Println("Updated environment.")
+		}
+	case "env status":
+		r, err := many.LoadRepo(*argRepo, *argFile)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		var at time.Time
+		if *argEnvStatusAt != "" {
+			at, err = parseTime(*argEnvStatusAt)
+			if err != nil {
+				lstderr.Fatal(err)
+			}
+		}
+		es, err := r.ManyFile.FindEnvironments(splitNames(*argEnvStatusName))
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		evs := []many.EnvironmentView{}
+		for _, e := range es {
+			evs = append(evs, many.NewEnvironmentView(e, at))
+		}
+		err = writeEnvironments(os.Stdout, *argEnvStatusOutput, evs)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+	case "env history":
+		r, err := many.LoadRepo(*argRepo, *argFile)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		e, err := r.ManyFile.Environment(*argEnvHistoryName)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		err = writeDeployments(os.Stdout, *argEnvHistoryOutput, e.Deployments)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+	case "rollback":
+		author := *argRollbackAuthor
+		if author == "" {
+			author = many.DefaultAuthor(*argRepo)
+		}
+		var rb many.Rollback
+		err := updateRepo(*argRepo, *argFile, *argLockTimeout, *argRollbackDryRun, func(m *many.Manyfile) error {
+			var err error
+			rb, err = m.Rollback(*argRollbackEnv, *argRollbackVersion, author, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		err = writeDiff(os.Stdout, OutputTable, rb.Diff)
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		what := "product"
+		if rb.Environment != "" {
+			what = rb.Environment
+		}
+		if *argRollbackDryRun {
+			lstdout.Printf("Would roll back %s from %s to %s.\n", what, rb.From, rb.To)
+		} else {
+			lstdout.Printf("Rolled back %s from %s to %s.\n", what, rb.From, rb.To)
+		}
+	case "migrate":
+		var before, after []byte
+		err := many.WithLock(*argRepo, *argLockTimeout, func() error {
+			r, err := many.LoadRepo(*argRepo, *argFile)
+			if err != nil {
+				return err
+			}
+			before, after, err = r.Migrate(*argMigrateDryRun)
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		if *argMigrateDryRun {
+			d, err := unifiedDiff(*argFile, *argFile, string(before), string(after))
+			if err != nil {
+				lstderr.Fatal(err)
+			}
+			os.Stdout.WriteString(d)
+		} else if bytes.Equal(before, after) {
+			lstdout.Printf("Already at schema version %d.\n", many.SchemaVersion)
+		} else {
+			lstdout.Printf("Migrated to schema version %d.\n", many.SchemaVersion)
+		}
+	case "lint":
+		var ps many.Problems
+		var err error
+		if *argLintFix {
+			_, err = many.UpdateRepo(*argRepo, *argFile, *argLockTimeout, func(m *many.Manyfile) error {
+				ps = m.Lint(true)
+				return nil
+			})
+		} else {
+			var r *many.Repo
+			r, err = many.LoadRepo(*argRepo, *argFile)
+			if err == nil {
+				ps = r.ManyFile.Lint(false)
+			}
+		}
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		if len(ps) == 0 {
+			lstdout.Println("No problems found.")
+		}
+		for _, p := range ps {
+			lstdout.Printf("%s: %s\n", *argFile, p)
+		}
+		if ps.HasErrors() {
+			os.Exit(1)
+		}
+	case "convert":
+		var r *many.Repo
+		err := many.WithLock(*argRepo, *argLockTimeout, func() error {
+			var err error
+			r, err = many.LoadRepo(*argRepo, *argFile)
+			if err != nil {
+				return err
+			}
+			r, err = r.Convert(*argConvertTo)
+			return err
+		})
+		if err != nil {
+			lstderr.Fatal(err)
+		}
+		if r.File == filepath.Join(*argRepo, *argFile) {
+			lstdout.Printf("%s is already %s.\n", *argFile, *argConvertTo)
+		} else {
+			lstdout.Printf("Converted %s to %s.\n", *argFile, filepath.Base(r.File))
+		}
+	}
+}
+
+// Change the Manyfile in a repo like many.UpdateRepo, or make the change
+// without saving it if dryRun is set.
+func updateRepo(
+	repo string,
+	file string,
+	timeout time.Duration,
+	dryRun bool,
+	change func(m *many.Manyfile) error,
+) error {
+	if !dryRun {
+		_, err := many.UpdateRepo(repo, file, timeout, change)
+		return err
+	}
+	r, err := many.LoadRepo(repo, file)
+	if err != nil {
+		return err
+	}
+	return change(&r.ManyFile)
+}
+
+// Parse a time given on the command line: RFC 3339, or a date meaning the
+// end of that day in local time.
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	d, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q. Use RFC 3339 or YYYY-MM-DD.", s)
 	}
+	return d.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rubberydub/many/pkg/many"
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats.
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+	// Only for output meant to be pasted into documents.
+	OutputMarkdown = "markdown"
+)
+
+// Split a CSV list of names, ignoring whitespace and empty entries.
+func splitNames(csv string) []string {
+	var ns []string
+	for _, n := range strings.Split(csv, ",") {
+		n = strings.TrimSpace(n)
+		if n != "" {
+			ns = append(ns, n)
+		}
+	}
+	return ns
+}
+
+// Write a value as JSON or YAML.
+func writeData(w io.Writer, format string, v interface{}) error {
+	switch format {
+	case OutputJSON:
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(v)
+	case OutputYAML:
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	return fmt.Errorf("Unknown output format %s.", format)
+}
+
+// Write services in the given format.
+func writeServices(w io.Writer, format string, svs []many.ServiceView) error {
+	if format != OutputTable {
+		return writeData(w, format, svs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, sv := range svs {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "Service:\t%s\n", sv.Name)
+		fmt.Fprintf(tw, "Description:\t%s\n", sv.Description)
+		fmt.Fprintf(tw, "Git:\t%s\n", sv.Git)
+		fmt.Fprintf(tw, "Docker:\t%s\n", sv.Docker)
+		if sv.Candidate != nil {
+			fmt.Fprintf(
+				tw,
+				"Candidate:\t%s\t%s\t%s\n",
+				sv.Candidate.Name,
+				sv.Candidate.Date.Format(time.RFC3339),
+				sv.Candidate.Author,
+			)
+		} else {
+			fmt.Fprintf(tw, "Candidate:\t\n")
+		}
+		if len(sv.Versions) == 0 {
+			fmt.Fprintf(tw, "Versions:\t\n")
+			continue
+		}
+		fmt.Fprintf(tw, "Versions:\n")
+		fmt.Fprintf(tw, "  VERSION\tDATE\tAUTHOR\tDESCRIPTION\n")
+		for _, v := range sv.Versions {
+			fmt.Fprintf(
+				tw,
+				"  %s\t%s\t%s\t%s\n",
+				v.Name,
+				v.Date.Format(time.RFC3339),
+				v.Author,
+				v.Description,
+			)
+		}
+	}
+	return tw.Flush()
+}
+
+// Write an overall version in the given format.
+func writeRelease(w io.Writer, format string, vv many.VersionView) error {
+	if format != OutputTable {
+		return writeData(w, format, vv)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Version:\t%s\n", vv.Name)
+	fmt.Fprintf(tw, "Description:\t%s\n", vv.Description)
+	fmt.Fprintf(tw, "Date:\t%s\n", vv.Date.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Author:\t%s\n", vv.Author)
+	if vv.Incompatible {
+		fmt.Fprintf(tw, "Incompatible:\tyes\n")
+	}
+	if len(vv.Services) == 0 {
+		fmt.Fprintf(tw, "Services:\t\n")
+		return tw.Flush()
+	}
+	fmt.Fprintf(tw, "Services:\n")
+	fmt.Fprintf(tw, "  SERVICE\tVERSION\n")
+	var ns []string
+	for n := range vv.Services {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	for _, n := range ns {
+		fmt.Fprintf(tw, "  %s\t%s\n", n, vv.Services[n])
+	}
+	return tw.Flush()
+}
+
+// Write the differences between overall versions in the given format.
+func writeDiff(w io.Writer, format string, d many.ReleaseDiff) error {
+	// Count the changes.
+	var counts []string
+	for _, c := range []many.Change{
+		many.ChangeAdded,
+		many.ChangeRemoved,
+		many.ChangeChanged,
+		many.ChangeUnchanged,
+	} {
+		counts = append(counts, fmt.Sprintf("%d %s", len(d.Filter(c)), c))
+	}
+	summary := strings.Join(counts, ", ") + "."
+	switch format {
+	case OutputTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "From:\t%s\n", d.From)
+		fmt.Fprintf(tw, "To:\t%s\n", d.To)
+		fmt.Fprintf(tw, "Services:\n")
+		fmt.Fprintf(tw, "  SERVICE\tCHANGE\tFROM\tTO\n")
+		for _, sd := range d.Services {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", sd.Service, sd.Change, sd.From, sd.To)
+		}
+		fmt.Fprintf(tw, "%s\n", summary)
+		return tw.Flush()
+	case OutputMarkdown:
+		fmt.Fprintf(w, "### Changes from %s to %s\n\n", d.From, d.To)
+		fmt.Fprintf(w, "| Service | Change | Version |\n")
+		fmt.Fprintf(w, "|---------|--------|---------|\n")
+		for _, sd := range d.Services {
+			v := sd.To
+			switch sd.Change {
+			case many.ChangeChanged:
+				v = fmt.Sprintf("%s \u2192 %s", sd.From, sd.To)
+			case many.ChangeRemoved:
+				v = fmt.Sprintf("~~%s~~", sd.From)
+			}
+			fmt.Fprintf(w, "| %s | %s | %s |\n", sd.Service, sd.Change, v)
+		}
+		fmt.Fprintf(w, "\n%s\n", summary)
+		return nil
+	}
+	return writeData(w, format, d)
+}
+
+// A group of commits in a changelog.
+type commitGroup struct {
+	// The conventional commit type. "!" for breaking changes of any type,
+	// empty for other commits.
+	Type  string
+	Title string
+}
+
+// The groups of commits in changelogs, in order.
+var commitGroups = []commitGroup{
+	{"!", "Breaking Changes"},
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance"},
+	{"revert", "Reverts"},
+	{"", "Other Changes"},
+}
+
+// Write a changelog in the given format. The markdown format lists each
+// service's commits, grouped by conventional commit type if group is set.
+func writeChangelog(w io.Writer, format string, cl many.Changelog, group bool) error {
+	if format != OutputMarkdown {
+		return writeData(w, format, cl)
+	}
+	fmt.Fprintf(w, "## Changes from %s to %s\n", cl.From, cl.To)
+	if len(cl.Services) == 0 {
+		fmt.Fprintf(w, "\nNo services changed.\n")
+	}
+	for _, sc := range cl.Services {
+		fmt.Fprintf(w, "\n### %s (%s \u2192 %s)\n", sc.Service, sc.From, sc.To)
+		if len(sc.Commits) == 0 {
+			fmt.Fprintf(w, "\nNo commits.\n")
+			continue
+		}
+		if !group {
+			fmt.Fprintln(w)
+			writeCommits(w, sc.Commits)
+			continue
+		}
+		// Group the commits.
+		groups := map[string][]many.Commit{}
+		for _, c := range sc.Commits {
+			t := ""
+			for _, g := range commitGroups {
+				if g.Type == c.Type || g.Type == "!" && c.Breaking {
+					t = g.Type
+					break
+				}
+			}
+			groups[t] = append(groups[t], c)
+		}
+		for _, g := range commitGroups {
+			if len(groups[g.Type]) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "\n#### %s\n\n", g.Title)
+			writeCommits(w, groups[g.Type])
+		}
+	}
+	return nil
+}
+
+// Write commits as a markdown list.
+func writeCommits(w io.Writer, cs []many.Commit) {
+	for _, c := range cs {
+		h := c.Hash
+		if len(h) > 7 {
+			h = h[:7]
+		}
+		fmt.Fprintf(w, "- %s (%s, %s)\n", c.Subject, h, c.Author)
+	}
+}
+
+// Write image checks in the given format.
+func writeChecks(w io.Writer, format string, checks []many.ImageCheck) error {
+	if format != OutputTable {
+		return writeData(w, format, checks)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "SERVICE\tVERSION\tSTATUS\tDIGEST\n")
+	for _, c := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Service, c.Version, c.Status, c.Digest)
+	}
+	return tw.Flush()
+}
+
+// Write the results of tagging images in the given format.
+func writeTags(w io.Writer, format string, rs []many.TagResult) error {
+	if format != OutputTable {
+		return writeData(w, format, rs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "SERVICE\tVERSION\tTAG\tSTATUS\tDIGEST\n")
+	for _, r := range rs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Service, r.Version, r.Tag, r.Status, r.Digest)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+	// The errors are too long for the table.
+	for _, r := range rs {
+		if r.Error != "" {
+			fmt.Fprintf(w, "%s: %s\n", r.Service, r.Error)
+		}
+	}
+	return nil
+}
+
+// Write what happened to git tags.
+func writeGitTags(w io.Writer, ts []many.GitTag) {
+	for _, t := range ts {
+		c := t.Commit
+		if len(c) > 7 {
+			c = c[:7]
+		}
+		switch t.Status {
+		case many.TagCreated:
+			fmt.Fprintf(w, "Tagged %s %s (%s) as %s.\n", t.Service, t.Version, c, t.Tag)
+		case many.TagPlanned:
+			fmt.Fprintf(w, "Would tag %s %s (%s) as %s.\n", t.Service, t.Version, c, t.Tag)
+		case many.TagUnchanged:
+			fmt.Fprintf(w, "Tag %s of %s already exists.\n", t.Tag, t.Service)
+		case many.TagSkipped:
+			fmt.Fprintf(w, "Skipped %s, it has no git repository.\n", t.Service)
+		}
+	}
+}
+
+// Write environments and what is deployed in them in the given format.
+func writeEnvironments(w io.Writer, format string, evs []many.EnvironmentView) error {
+	if format != OutputTable {
+		return writeData(w, format, evs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, ev := range evs {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "Environment:\t%s\n", ev.Name)
+		fmt.Fprintf(tw, "Description:\t%s\n", ev.Description)
+		d := ev.Deployment
+		if d == nil {
+			fmt.Fprintf(tw, "Version:\t\n")
+			continue
+		}
+		fmt.Fprintf(tw, "Version:\t%s\n", d.Release)
+		fmt.Fprintf(tw, "Deployed:\t%s\n", d.Date.Format(time.RFC3339))
+		fmt.Fprintf(tw, "Author:\t%s\n", d.Author)
+		if len(d.Services) == 0 {
+			fmt.Fprintf(tw, "Services:\t\n")
+			continue
+		}
+		fmt.Fprintf(tw, "Services:\n")
+		fmt.Fprintf(tw, "  SERVICE\tVERSION\n")
+		var ns []string
+		for n := range d.Services {
+			ns = append(ns, n)
+		}
+		sort.Strings(ns)
+		for _, n := range ns {
+			fmt.Fprintf(tw, "  %s\t%s\n", n, d.Services[n])
+		}
+	}
+	return tw.Flush()
+}
+
+// Write an environment's deployments, newest first, in the given format.
+func writeDeployments(w io.Writer, format string, ds many.Deployments) error {
+	// Deployments are kept oldest first.
+	rs := make(many.Deployments, 0, len(ds))
+	for i := len(ds) - 1; i >= 0; i-- {
+		rs = append(rs, ds[i])
+	}
+	if format != OutputTable {
+		return writeData(w, format, rs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "VERSION\tDATE\tAUTHOR\n")
+	for _, d := range rs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Release, d.Date.Format(time.RFC3339), d.Author)
+	}
+	return tw.Flush()
+}
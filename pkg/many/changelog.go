@@ -0,0 +1,176 @@
+package many
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Conventional commit subjects, for example "feat(api)!: remove v1". See
+// https://www.conventionalcommits.org.
+var conventionalRegexp = regexp.MustCompile(`^([A-Za-z]+)(?:\(([^)]*)\))?(!)?: *(.*)$`)
+
+// A commit in a service's history.
+type Commit struct {
+	Hash    string    `json:"hash" yaml:"hash"`
+	Author  string    `json:"author" yaml:"author"`
+	Date    time.Time `json:"date" yaml:"date"`
+	Subject string    `json:"subject" yaml:"subject"`
+	// The conventional commit type and scope, empty if the subject isn't a
+	// conventional commit.
+	Type     string `json:"type,omitempty" yaml:"type,omitempty"`
+	Scope    string `json:"scope,omitempty" yaml:"scope,omitempty"`
+	Breaking bool   `json:"breaking,omitempty" yaml:"breaking,omitempty"`
+}
+
+// The commits to a service between its versions in two overall versions.
+type ServiceChangelog struct {
+	Service string   `json:"service" yaml:"service"`
+	From    string   `json:"from" yaml:"from"`
+	To      string   `json:"to" yaml:"to"`
+	Commits []Commit `json:"commits" yaml:"commits"`
+}
+
+// The changes between two overall versions.
+type Changelog struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+	// The services whose version changed, by name.
+	Services []ServiceChangelog `json:"services" yaml:"services"`
+}
+
+// The default directory for mirrors of the services' git repositories, in
+// the user's cache directory.
+func DefaultMirrorDir() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "many", "mirrors"), nil
+}
+
+// Create or update a mirror of a service's git repository in a directory of
+// mirrors. Returns the mirror's path.
+func (s Service) mirror(dir string) (string, error) {
+	if s.Git == "" {
+		return "", errorf(
+			ErrInvalidService,
+			"Service %s has no git repository. Use create --update --git to set it.",
+			s.Name,
+		)
+	}
+	// Name the mirror after the service and its URL, so changing the URL
+	// makes a new mirror.
+	sum := sha256.Sum256([]byte(s.Git))
+	p := filepath.Join(dir, fmt.Sprintf("%s-%x.git", s.Name, sum[:4]))
+	_, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return "", err
+		}
+		_, err = git(dir, "clone", "--quiet", "--mirror", s.Git, p)
+		return p, err
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = git(p, "remote", "update", "--prune")
+	return p, err
+}
+
+// Resolve a service's version to a commit in its repository. Versions are
+// commits or tags, semantic versions may also be tags with a "v" prefix.
+func resolveRevision(dir string, service string, version string) (string, error) {
+	for _, r := range []string{version, "v" + version} {
+		h, err := git(dir, "rev-parse", "--quiet", "--verify", r+"^{commit}")
+		if err == nil {
+			return h, nil
+		}
+	}
+	return "", errorf(
+		ErrVersionNotFound,
+		"Version %s of service %s is not a commit or tag in its repository.",
+		version,
+		service,
+	)
+}
+
+// List the commits between two revisions, newest first. Merges are left out.
+func listCommits(dir string, from string, to string) ([]Commit, error) {
+	// Fields are separated by unit separators and commits by record
+	// separators, neither appear in subjects.
+	out, err := gitRaw(
+		dir,
+		"log",
+		"--no-merges",
+		"--format=%H%x1f%an%x1f%aI%x1f%s%x1e",
+		from+".."+to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	cs := []Commit{}
+	for _, r := range strings.Split(out, "\x1e") {
+		f := strings.Split(strings.TrimSpace(r), "\x1f")
+		if len(f) != 4 {
+			continue
+		}
+		d, err := time.Parse(time.RFC3339, f[2])
+		if err != nil {
+			return nil, err
+		}
+		c := Commit{Hash: f[0], Author: f[1], Date: d, Subject: f[3]}
+		if m := conventionalRegexp.FindStringSubmatch(c.Subject); m != nil {
+			c.Type = strings.ToLower(m[1])
+			c.Scope = m[2]
+			c.Breaking = m[3] == "!"
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// Create a changelog of the services whose version changed between two
+// overall versions, from mirrors of their git repositories in a directory.
+// The mirrors are created or updated as needed.
+func (m Manyfile) Changelog(from string, to string, mirrors string) (Changelog, error) {
+	d, err := m.DiffReleases(from, to)
+	if err != nil {
+		return Changelog{}, err
+	}
+	cl := Changelog{From: from, To: to, Services: []ServiceChangelog{}}
+	for _, sd := range d.Filter(ChangeChanged) {
+		s, err := m.Service(sd.Service)
+		if err != nil {
+			return Changelog{}, err
+		}
+		p, err := s.mirror(mirrors)
+		if err != nil {
+			return Changelog{}, err
+		}
+		// Resolve both versions before listing, for clearer errors.
+		var revs [2]string
+		for i, v := range []string{sd.From, sd.To} {
+			revs[i], err = resolveRevision(p, s.Name, v)
+			if err != nil {
+				return Changelog{}, err
+			}
+		}
+		cs, err := listCommits(p, revs[0], revs[1])
+		if err != nil {
+			return Changelog{}, err
+		}
+		cl.Services = append(cl.Services, ServiceChangelog{
+			Service: s.Name,
+			From:    sd.From,
+			To:      sd.To,
+			Commits: cs,
+		})
+	}
+	return cl, nil
+}
@@ -0,0 +1,114 @@
+package many
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// Create a service repository with conventional commits, tagged v1.0.0 and
+// v1.1.0, and a merge between them.
+func testServiceRepo(t *testing.T) string {
+	t.Helper()
+	p := filepath.Join(testTempDir(t), "api")
+	testGit(t, filepath.Dir(p), "init", "--quiet", p)
+	commit := func(s string) {
+		testGit(t, p, "commit", "--quiet", "--allow-empty", "-m", s)
+	}
+	commit("feat: first")
+	testGit(t, p, "tag", "v1.0.0")
+	testGit(t, p, "checkout", "--quiet", "-b", "topic")
+	commit("fix(db): close connections")
+	testGit(t, p, "checkout", "--quiet", "-")
+	commit("Update the README")
+	testGit(t, p, "merge", "--quiet", "--no-ff", "-m", "Merge topic", "topic")
+	commit("feat(api)!: remove v1 endpoints")
+	testGit(t, p, "tag", "v1.1.0")
+	return p
+}
+
+func TestListCommits(t *testing.T) {
+	p := testServiceRepo(t)
+	cs, err := listCommits(p, "v1.0.0", "v1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Newest first, without the merge. The topic commit is older than the
+	// README commit.
+	want := []Commit{
+		{Subject: "feat(api)!: remove v1 endpoints", Type: "feat", Scope: "api", Breaking: true},
+		{Subject: "Update the README"},
+		{Subject: "fix(db): close connections", Type: "fix", Scope: "db"},
+	}
+	if len(cs) != len(want) {
+		t.Fatalf("got %d commits, want %d: %+v", len(cs), len(want), cs)
+	}
+	for i, w := range want {
+		c := cs[i]
+		if c.Subject != w.Subject || c.Type != w.Type || c.Scope != w.Scope || c.Breaking != w.Breaking {
+			t.Errorf("commit %d: got %+v, want %+v", i, c, w)
+		}
+		if c.Author != "Tester" || len(c.Hash) != 40 || c.Date.IsZero() {
+			t.Errorf("commit %d: got author %q, hash %q and date %s", i, c.Author, c.Hash, c.Date)
+		}
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	p := testServiceRepo(t)
+	m := Manyfile{
+		Services: Services{
+			"api": {Name: "api", Git: p},
+			"web": {Name: "web"},
+		},
+		Versions: Versions{
+			{Name: "v1.0.0", Services: map[string]string{"api": "1.0.0", "web": "2.0.0"}},
+			{Name: "v1.1.0", Services: map[string]string{"api": "1.1.0", "web": "2.0.0"}},
+		},
+	}
+	mirrors := testTempDir(t)
+	cl, err := m.Changelog("v1.0.0", "v1.1.0", mirrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only api changed, so web needs no repository.
+	if len(cl.Services) != 1 {
+		t.Fatalf("got services %+v, want api", cl.Services)
+	}
+	sc := cl.Services[0]
+	if sc.Service != "api" || sc.From != "1.0.0" || sc.To != "1.1.0" {
+		t.Errorf("got %s from %s to %s", sc.Service, sc.From, sc.To)
+	}
+	if len(sc.Commits) != 3 || sc.Commits[0].Subject != "feat(api)!: remove v1 endpoints" {
+		t.Errorf("got commits %+v", sc.Commits)
+	}
+	// New commits are fetched into the existing mirror.
+	testGit(t, p, "commit", "--quiet", "--allow-empty", "-m", "fix: retry")
+	testGit(t, p, "tag", "v1.1.1")
+	m.Versions.Add(Version{Name: "v1.1.1", Services: map[string]string{"api": "1.1.1", "web": "2.0.0"}})
+	cl, err = m.Changelog("v1.1.0", "v1.1.1", mirrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.Services) != 1 || len(cl.Services[0].Commits) != 1 {
+		t.Fatalf("got %+v, want the one new commit", cl.Services)
+	}
+	if c := cl.Services[0].Commits[0]; c.Type != "fix" || c.Subject != "fix: retry" {
+		t.Errorf("got commit %+v", c)
+	}
+}
+
+func TestChangelogUnknownVersion(t *testing.T) {
+	p := testServiceRepo(t)
+	m := Manyfile{
+		Services: Services{"api": {Name: "api", Git: p}},
+		Versions: Versions{
+			{Name: "v1.0.0", Services: map[string]string{"api": "1.0.0"}},
+			{Name: "v2.0.0", Services: map[string]string{"api": "9.9.9"}},
+		},
+	}
+	_, err := m.Changelog("v1.0.0", "v2.0.0", testTempDir(t))
+	if !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("got error %v, want ErrVersionNotFound", err)
+	}
+}
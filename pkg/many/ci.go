@@ -0,0 +1,93 @@
+package many
+
+import (
+	"strings"
+	"time"
+)
+
+// Environment variables of CI systems, in order of preference. GitHub
+// Actions, GitLab CI, Jenkins, CircleCI, Travis CI and Buildkite are covered.
+var (
+	// The commit being built.
+	ciCommitVars = []string{
+		"GITHUB_SHA",
+		"CI_COMMIT_SHA",
+		"GIT_COMMIT",
+		"CIRCLE_SHA1",
+		"TRAVIS_COMMIT",
+		"BUILDKITE_COMMIT",
+	}
+	// The build number.
+	ciNumberVars = []string{
+		"GITHUB_RUN_NUMBER",
+		"CI_PIPELINE_IID",
+		"BUILD_NUMBER",
+		"CIRCLE_BUILD_NUM",
+		"TRAVIS_BUILD_NUMBER",
+		"BUILDKITE_BUILD_NUMBER",
+	}
+	// Who started the build. Jenkins only has it with the build user vars
+	// plugin.
+	ciActorVars = []string{
+		"GITHUB_ACTOR",
+		"GITLAB_USER_LOGIN",
+		"BUILD_USER_ID",
+		"CIRCLE_USERNAME",
+		"BUILDKITE_BUILD_CREATOR",
+	}
+	// The commit message. Only the first line is used.
+	ciMessageVars = []string{
+		"CI_COMMIT_TITLE",
+		"TRAVIS_COMMIT_MESSAGE",
+		"BUILDKITE_MESSAGE",
+	}
+	// When the build started, in RFC 3339.
+	ciDateVars = []string{
+		"CI_PIPELINE_CREATED_AT",
+	}
+)
+
+// The details of a CI build. Fields the CI system doesn't give are empty.
+type CIBuild struct {
+	Commit  string
+	Number  string
+	Actor   string
+	Subject string
+	Date    time.Time
+}
+
+// Get the first non-empty variable.
+func firstVar(getenv func(string) string, names []string) string {
+	for _, n := range names {
+		if v := strings.TrimSpace(getenv(n)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Read the details of a CI build from environment variables with getenv,
+// such as os.Getenv. The variables are the same on every retry of a build, so
+// the details are too.
+func CIBuildFromEnv(getenv func(string) string) CIBuild {
+	b := CIBuild{
+		Commit: firstVar(getenv, ciCommitVars),
+		Number: firstVar(getenv, ciNumberVars),
+		Actor:  firstVar(getenv, ciActorVars),
+	}
+	b.Subject = strings.TrimSpace(strings.SplitN(firstVar(getenv, ciMessageVars), "\n", 2)[0])
+	if d, err := time.Parse(time.RFC3339, firstVar(getenv, ciDateVars)); err == nil {
+		b.Date = d.UTC()
+	}
+	return b
+}
+
+// Get the subject of a commit in a git repository. Empty if the directory
+// isn't a git repository or doesn't have the commit.
+func CommitSubject(dir string, rev string) string {
+	s, err := git(dir, "show", "--no-patch", "--format=%s", rev+"^{commit}")
+	if err != nil {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,309 @@
+package many
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// A Codec reads and writes Manyfiles in a file format.
+type Codec interface {
+	// Encode a value to w. The value is a Manyfile, or a
+	// map[string]interface{} when migrating.
+	Encode(w io.Writer, v interface{}) error
+	// Decode data into a value. The value is a *Manyfile, or a
+	// *map[string]interface{} when migrating, in which case nested tables
+	// must also be map[string]interface{}.
+	Decode(data []byte, v interface{}) error
+}
+
+// A codec that refuses unknown fields, and can also decode ignoring them for
+// Manyfiles with a newer schema version.
+type lenientCodec interface {
+	decodeLenient(data []byte, v interface{}) error
+}
+
+// The Manyfile formats, keyed by file extension.
+var codecs = map[string]Codec{
+	".toml": TOMLCodec{},
+	".json": JSONCodec{},
+	".yaml": YAMLCodec{},
+	".yml":  YAMLCodec{},
+}
+
+// The Manyfile names looked for by FindManyfile, in order of preference.
+var manyfileNames = []string{
+	"Many.toml",
+	"Many.yaml",
+	"Many.yml",
+	"Many.json",
+}
+
+// The name of a new Manyfile if none exists.
+const DefaultManyfile = "Many.toml"
+
+// Register a codec for a file extension, for example ".ini". Replaces any
+// codec already registered for the extension.
+func RegisterCodec(ext string, c Codec) {
+	codecs[strings.ToLower(ext)] = c
+}
+
+// Get the codec for a file or a format by its extension, with or without the
+// dot.
+func CodecFor(file string) (Codec, error) {
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext == "" {
+		ext = "." + strings.ToLower(file)
+	}
+	c, ok := codecs[ext]
+	if !ok {
+		return nil, errorf(
+			ErrUnknownFormat,
+			"Unknown Manyfile format %s. Use one of %s.",
+			strings.TrimPrefix(ext, "."),
+			strings.Join(Formats(), ", "),
+		)
+	}
+	return c, nil
+}
+
+// The extensions of the registered formats, without the dot.
+func Formats() []string {
+	var fs []string
+	for ext := range codecs {
+		fs = append(fs, strings.TrimPrefix(ext, "."))
+	}
+	sort.Strings(fs)
+	return fs
+}
+
+// Detect the codec of a Manyfile from its content, for files without a known
+// extension such as the temporary files given to merge drivers.
+func DetectCodec(data []byte) (Codec, error) {
+	var raw map[string]interface{}
+	for _, c := range []Codec{JSONCodec{}, TOMLCodec{}, YAMLCodec{}} {
+		if c.Decode(data, &raw) == nil {
+			return c, nil
+		}
+	}
+	return nil, errorf(ErrUnknownFormat, "Unknown Manyfile format.")
+}
+
+// Find the Manyfile in a repo. Returns the default name if there is none.
+func FindManyfile(repo string) string {
+	for _, n := range manyfileNames {
+		_, err := os.Stat(filepath.Join(repo, n))
+		if err == nil {
+			return n
+		}
+	}
+	return DefaultManyfile
+}
+
+// Convert the repo's Manyfile to another format, replacing it with a file of
+// the same name and the format's extension, for example "yaml". The change is
+// staged if the repo is a git repository. Conversions that would lose data are
+// refused, except that dates are kept to the second as TOML keeps them.
+// Returns the converted repo, or the repo itself if it is already in the
+// format.
+func (r *Repo) Convert(format string) (*Repo, error) {
+	from, err := CodecFor(r.File)
+	if err != nil {
+		return nil, err
+	}
+	to, err := CodecFor(format)
+	if err != nil {
+		return nil, err
+	}
+	old, err := r.relFile()
+	if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(old)
+	name := strings.TrimSuffix(old, ext) + "." + strings.TrimPrefix(format, ".")
+	if strings.EqualFold(ext, filepath.Ext(name)) {
+		return r, nil
+	}
+	c := NewRepo(r.Path, name, Manyfile{})
+	_, err = os.Stat(c.File)
+	if err == nil {
+		return nil, errorf(ErrManyfileExists, "%s already exists.", c.File)
+	}
+	// Encode in the new format and check decoding it gives the same Manyfile.
+	src := truncateDates(r.ManyFile)
+	var b bytes.Buffer
+	err = EncodeManyfile(&b, to, src)
+	if err != nil {
+		return nil, err
+	}
+	m, err := DecodeManyfile(to, b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var b1, b2 bytes.Buffer
+	err = EncodeManyfile(&b1, from, src)
+	if err != nil {
+		return nil, err
+	}
+	err = EncodeManyfile(&b2, from, m)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+		return nil, errorf(
+			ErrInvalidManyfile,
+			"Converting %s to %s would lose data.",
+			r.File,
+			format,
+		)
+	}
+	// Replace the Manyfile.
+	err = writeFileAtomic(c.File, b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	err = os.Remove(r.File)
+	if err != nil {
+		return nil, err
+	}
+	// Stage the new file, and the removal of the old one if it was tracked.
+	if isGitRepo(r.Path) {
+		_, err = git(r.Path, "add", "--", name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = git(r.Path, "rm", "--quiet", "--cached", "--ignore-unmatch", "--", old)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.ManyFile = m
+	err = c.track()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Copy a Manyfile with the sub-second part of its dates dropped.
+func truncateDates(m Manyfile) Manyfile {
+	versions := func(vs Versions) Versions {
+		if vs == nil {
+			return nil
+		}
+		c := make(Versions, len(vs))
+		for i, v := range vs {
+			v.Date = v.Date.Truncate(time.Second)
+			c[i] = v
+		}
+		return c
+	}
+	m.Versions = versions(m.Versions)
+	if m.Services != nil {
+		ss := Services{}
+		for n, s := range m.Services {
+			s.Candidate.Date = s.Candidate.Date.Truncate(time.Second)
+			s.Versions = versions(s.Versions)
+			ss[n] = s
+		}
+		m.Services = ss
+	}
+	if m.Environments != nil {
+		es := Environments{}
+		for n, e := range m.Environments {
+			if e.Deployments != nil {
+				ds := make(Deployments, len(e.Deployments))
+				for i, d := range e.Deployments {
+					d.Date = d.Date.Truncate(time.Second)
+					ds[i] = d
+				}
+				e.Deployments = ds
+			}
+			es[n] = e
+		}
+		m.Environments = es
+	}
+	return m
+}
+
+// The TOML format.
+type TOMLCodec struct{}
+
+func (TOMLCodec) Encode(w io.Writer, v interface{}) error {
+	return toml.NewEncoder(w).Encode(v)
+}
+
+func (TOMLCodec) Decode(data []byte, v interface{}) error {
+	_, err := toml.Decode(string(data), v)
+	return err
+}
+
+// The JSON format.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(w io.Writer, v interface{}) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+func (JSONCodec) decodeLenient(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// The YAML format.
+type YAMLCodec struct{}
+
+func (YAMLCodec) Encode(w io.Writer, v interface{}) error {
+	return yaml.NewEncoder(w).Encode(v)
+}
+
+func (YAMLCodec) Decode(data []byte, v interface{}) error {
+	err := yaml.UnmarshalStrict(data, v)
+	if err != nil {
+		return err
+	}
+	// The YAML package decodes nested tables with interface{} keys.
+	if raw, ok := v.(*map[string]interface{}); ok {
+		for k, e := range *raw {
+			(*raw)[k] = stringKeys(e)
+		}
+	}
+	return nil
+}
+
+func (YAMLCodec) decodeLenient(data []byte, v interface{}) error {
+	return yaml.Unmarshal(data, v)
+}
+
+// Convert the keys of decoded YAML tables to strings.
+func stringKeys(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range t {
+			t[i] = stringKeys(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+package many
+
+// How a service changed between overall versions.
+type Change string
+
+const (
+	ChangeAdded     Change = "added"
+	ChangeRemoved   Change = "removed"
+	ChangeChanged   Change = "changed"
+	ChangeUnchanged Change = "unchanged"
+)
+
+// A service's versions in two overall versions. From is empty for added
+// services and To for removed services.
+type ServiceDiff struct {
+	Service string `json:"service" yaml:"service"`
+	Change  Change `json:"change" yaml:"change"`
+	From    string `json:"from,omitempty" yaml:"from,omitempty"`
+	To      string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// The differences between two overall versions.
+type ReleaseDiff struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+	// Every service in either overall version, by name.
+	Services []ServiceDiff `json:"services" yaml:"services"`
+}
+
+// Get the services of a kind of change.
+func (d ReleaseDiff) Filter(c Change) []ServiceDiff {
+	var sds []ServiceDiff
+	for _, sd := range d.Services {
+		if sd.Change == c {
+			sds = append(sds, sd)
+		}
+	}
+	return sds
+}
+
+// Compare the services of two overall versions. Both must record their
+// services.
+func (m Manyfile) DiffReleases(from string, to string) (ReleaseDiff, error) {
+	var vs [2]Version
+	for i, n := range []string{from, to} {
+		v, err := m.FindRelease(n)
+		if err != nil {
+			return ReleaseDiff{}, err
+		}
+		if len(v.Services) == 0 {
+			return ReleaseDiff{}, errorf(
+				ErrNoServices,
+				"Version %s doesn't record the versions of its services.",
+				n,
+			)
+		}
+		vs[i] = v
+	}
+	d := ReleaseDiff{From: from, To: to}
+	// The services in either version, in order.
+	ns := sortedKeys(func(add func(string)) {
+		for _, v := range vs {
+			for n := range v.Services {
+				add(n)
+			}
+		}
+	})
+	for _, n := range ns {
+		f, inFrom := vs[0].Services[n]
+		t, inTo := vs[1].Services[n]
+		sd := ServiceDiff{Service: n, From: f, To: t}
+		switch {
+		case !inFrom:
+			sd.Change = ChangeAdded
+		case !inTo:
+			sd.Change = ChangeRemoved
+		case f != t:
+			sd.Change = ChangeChanged
+		default:
+			sd.Change = ChangeUnchanged
+		}
+		d.Services = append(d.Services, sd)
+	}
+	return d, nil
+}
@@ -0,0 +1,186 @@
+package many
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Part of the sort interface.
+func (ds Deployments) Len() int {
+	return len(ds)
+}
+
+// Part of the sort interface.
+func (ds Deployments) Swap(i, j int) {
+	ds[i], ds[j] = ds[j], ds[i]
+}
+
+// Part of the sort interface. Deployments are ordered by date.
+func (ds Deployments) Less(i, j int) bool {
+	return ds[i].Date.Before(ds[j].Date)
+}
+
+// Check if two deployments are the same.
+func (d1 Deployment) Equal(d2 Deployment) bool {
+	if d1.Release != d2.Release ||
+		!d1.Date.Equal(d2.Date) ||
+		d1.Author != d2.Author ||
+		len(d1.Services) != len(d2.Services) {
+		return false
+	}
+	for n, sv := range d1.Services {
+		if d2.Services[n] != sv {
+			return false
+		}
+	}
+	return true
+}
+
+// Check if a deployment is in a history of deployments.
+func (ds Deployments) contains(d Deployment) bool {
+	for _, o := range ds {
+		if o.Equal(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Combine two histories of deployments, keeping the deployments in either
+// once. Deployments are only ever added, so histories merge without
+// conflicts.
+func mergeDeployments(ds1 Deployments, ds2 Deployments) Deployments {
+	ds := append(Deployments{}, ds1...)
+	for _, d2 := range ds2 {
+		if !ds1.contains(d2) {
+			ds = append(ds, d2)
+		}
+	}
+	sort.Stable(ds)
+	return ds
+}
+
+// Get the latest deployment to an environment.
+func (e Environment) Current() (Deployment, bool) {
+	if len(e.Deployments) == 0 {
+		return Deployment{}, false
+	}
+	return e.Deployments[len(e.Deployments)-1], true
+}
+
+// Get the deployment that was in an environment at a time, the latest
+// deployment at or before it.
+func (e Environment) At(t time.Time) (Deployment, bool) {
+	for i := len(e.Deployments) - 1; i >= 0; i-- {
+		if !e.Deployments[i].Date.After(t) {
+			return e.Deployments[i], true
+		}
+	}
+	return Deployment{}, false
+}
+
+// Get an environment by name.
+func (m Manyfile) Environment(name string) (Environment, error) {
+	e, ok := m.Environments[name]
+	if !ok {
+		return Environment{}, errorf(
+			ErrEnvironmentNotFound,
+			"Unknown environment %s. Use env add to add it.",
+			name,
+		)
+	}
+	return e, nil
+}
+
+// Add an environment. An existing environment is an error unless update is
+// set, in which case its description is updated. Returns true if the
+// environment was added.
+func (m *Manyfile) AddEnvironment(name string, description string, update bool) (bool, error) {
+	// Environment names follow the same rules as service names.
+	if !serviceNameRegexp.MatchString(name) {
+		return false, errorf(
+			ErrInvalidEnvironment,
+			"Invalid environment name %q. Use letters, digits, '.', '_' and '-'.",
+			name,
+		)
+	}
+	for n := range m.Environments {
+		if n != name && strings.EqualFold(n, name) {
+			return false, errorf(
+				ErrEnvironmentExists,
+				"Environment %s collides with existing environment %s.",
+				name,
+				n,
+			)
+		}
+	}
+	if m.Environments == nil {
+		m.Environments = Environments{}
+	}
+	e, ok := m.Environments[name]
+	if ok && !update {
+		return false, errorf(
+			ErrEnvironmentExists,
+			"Environment %s already exists. Use --update to update it.",
+			name,
+		)
+	}
+	e.Name = name
+	if description != "" || !ok {
+		e.Description = description
+	}
+	m.Environments[name] = e
+	return !ok, nil
+}
+
+// Record the deployment of an overall version to an environment, stamped
+// with the date and author.
+func (m *Manyfile) Deploy(
+	env string,
+	release string,
+	author string,
+	date time.Time,
+) (Deployment, error) {
+	e, err := m.Environment(env)
+	if err != nil {
+		return Deployment{}, err
+	}
+	v, err := m.FindRelease(release)
+	if err != nil {
+		return Deployment{}, err
+	}
+	d := Deployment{
+		Release:  v.Name,
+		Date:     date,
+		Author:   author,
+		Services: map[string]string{},
+	}
+	for n, sv := range v.Services {
+		d.Services[n] = sv
+	}
+	e.Deployments = append(e.Deployments, d)
+	sort.Stable(e.Deployments)
+	m.Environments[env] = e
+	return d, nil
+}
+
+// Get environments by name, all of them if no names are given.
+func (m Manyfile) FindEnvironments(names []string) ([]Environment, error) {
+	if len(names) == 0 {
+		names = sortedKeys(func(add func(string)) {
+			for n := range m.Environments {
+				add(n)
+			}
+		})
+	}
+	var es []Environment
+	for _, n := range names {
+		e, err := m.Environment(n)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
@@ -0,0 +1,76 @@
+package many
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors. The errors returned by this package wrap these, so callers
+// can check for them with errors.Is.
+var (
+	// Repositories.
+	ErrRepoExists       = errors.New("repository already exists")
+	ErrInvalidManyfile  = errors.New("invalid Manyfile")
+	ErrConcurrentChange = errors.New("Manyfile changed since it was loaded")
+	ErrLocked           = errors.New("repository is locked")
+	ErrSchemaTooNew     = errors.New("Manyfile schema version is too new")
+	ErrUnknownFormat    = errors.New("unknown Manyfile format")
+	ErrManyfileExists   = errors.New("Manyfile already exists")
+	ErrGit              = errors.New("git command failed")
+	ErrNotGitRepo       = errors.New("not a git repository")
+	ErrNoBranch         = errors.New("not on a branch")
+	ErrNoRemote         = errors.New("no remote")
+	ErrRemoteMismatch   = errors.New("remote already exists with another URL")
+	ErrHasHistory       = errors.New("local repository already has history")
+	ErrDirtyWorkTree    = errors.New("work tree has uncommitted changes")
+	ErrDiverged         = errors.New("local and remote histories have diverged")
+	ErrMergeConflict    = errors.New("merge conflict")
+	ErrNoCommonAncestor = errors.New("histories have no common ancestor")
+	// Services.
+	ErrInvalidService  = errors.New("invalid service")
+	ErrServiceExists   = errors.New("service already exists")
+	ErrServiceNotFound = errors.New("service not found")
+	ErrNoServices      = errors.New("no services")
+	// Versions.
+	ErrInvalidVersion  = errors.New("invalid semantic version")
+	ErrInvalidCategory = errors.New("invalid release category")
+	ErrNoCandidate     = errors.New("service has no candidate")
+	ErrNotCandidate    = errors.New("version is not the candidate")
+	ErrVersionExists   = errors.New("version already exists")
+	ErrVersionNotFound = errors.New("version not found")
+	ErrNoVersions      = errors.New("service has no versions")
+	ErrNoReleases      = errors.New("no releases")
+	ErrIncompatible    = errors.New("incompatible release")
+	// Environments.
+	ErrInvalidEnvironment  = errors.New("invalid environment")
+	ErrEnvironmentExists   = errors.New("environment already exists")
+	ErrEnvironmentNotFound = errors.New("environment not found")
+	ErrNotDeployed         = errors.New("nothing deployed")
+	// Images.
+	ErrRegistry       = errors.New("registry request failed")
+	ErrRegistryAuth   = errors.New("registry authentication failed")
+	ErrImageNotFound  = errors.New("image not found")
+	ErrDigestMismatch = errors.New("image digest changed")
+	ErrTagExists      = errors.New("image tag already exists")
+)
+
+// An error with a message for people and a kind for programs.
+type Error struct {
+	// One of the Err variables.
+	Kind    error
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Part of the errors.Is interface.
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// Create an error of a kind with a formatted message.
+func errorf(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
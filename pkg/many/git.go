@@ -0,0 +1,157 @@
+package many
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Run a git command in a directory and return its trimmed stdout.
+func git(dir string, args ...string) (string, error) {
+	out, err := gitRaw(dir, args...)
+	return strings.TrimSpace(out), err
+}
+
+// Run a git command in a directory and return its stdout as is.
+func gitRaw(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		// Include git's own message, it is usually the most helpful part.
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", errorf(ErrGit, "git %s: %s", args[0], msg)
+	}
+	return stdout.String(), nil
+}
+
+// Check if a directory is the top level of a git work tree.
+func isGitRepo(dir string) bool {
+	out, err := git(dir, "rev-parse", "--show-prefix")
+	// An empty prefix means the directory is the top level.
+	return err == nil && out == ""
+}
+
+// Find the default branch of a remote. An empty string is returned if the
+// remote has no branches.
+func remoteDefaultBranch(dir string, remote string) (string, error) {
+	// Ask for the branch the remote's HEAD points at.
+	out, err := git(dir, "ls-remote", "--symref", remote, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	for _, l := range strings.Split(out, "\n") {
+		// The symref line looks like "ref: refs/heads/master\tHEAD".
+		if strings.HasPrefix(l, "ref: refs/heads/") {
+			f := strings.Fields(strings.TrimPrefix(l, "ref: refs/heads/"))
+			if len(f) > 0 {
+				// HEAD may point at an unborn branch, check it exists.
+				h, err := git(dir, "ls-remote", "--heads", remote, f[0])
+				if err != nil {
+					return "", err
+				}
+				if h != "" {
+					return f[0], nil
+				}
+			}
+		}
+	}
+	// HEAD is detached or unborn. Fall back to the first branch, if any.
+	out, err = git(dir, "ls-remote", "--heads", remote)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range strings.Split(out, "\n") {
+		f := strings.Fields(l)
+		if len(f) == 2 {
+			return strings.TrimPrefix(f[1], "refs/heads/"), nil
+		}
+	}
+	return "", nil
+}
+
+// Add a remote to a repository, or check that the existing remote matches.
+func ensureRemote(dir string, name string, url string) error {
+	u, err := git(dir, "remote", "get-url", name)
+	if err != nil {
+		_, err = git(dir, "remote", "add", name, url)
+		return err
+	}
+	if u != url {
+		return errorf(
+			ErrRemoteMismatch,
+			"Git remote %s already exists with URL %s.",
+			name,
+			u,
+		)
+	}
+	return nil
+}
+
+// Get the current branch.
+func currentBranch(dir string) (string, error) {
+	b, err := git(dir, "symbolic-ref", "--quiet", "--short", "HEAD")
+	if err != nil {
+		return "", errorf(ErrNoBranch, "Not on a branch. Check out a branch first.")
+	}
+	return b, nil
+}
+
+// Check if HEAD points at a commit. It doesn't in a new repository.
+func hasCommits(dir string) bool {
+	_, err := git(dir, "rev-parse", "--verify", "--quiet", "HEAD")
+	return err == nil
+}
+
+// Get the paths with uncommitted changes, including untracked files.
+func changedPaths(dir string) ([]string, error) {
+	out, err := gitRaw(dir, "status", "--porcelain", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	var ps []string
+	es := strings.Split(out, "\x00")
+	for i := 0; i < len(es); i++ {
+		// Entries look like "XY path". Renames are followed by the old path.
+		if len(es[i]) > 3 {
+			ps = append(ps, es[i][3:])
+			if es[i][0] == 'R' || es[i][0] == 'C' {
+				i++
+			}
+		}
+	}
+	return ps, nil
+}
+
+// Count the commits reachable from one revision but not another.
+func countCommits(dir string, from string, to string) (int, error) {
+	out, err := git(dir, "rev-list", "--count", from+".."+to)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(out)
+}
+
+// Check if a merge is in progress.
+func hasMergeHead(dir string) bool {
+	_, err := git(dir, "rev-parse", "--verify", "--quiet", "MERGE_HEAD")
+	return err == nil
+}
+
+// Get the name to record as the author of changes. This is the git user,
+// falling back to the login name.
+func DefaultAuthor(dir string) string {
+	n, err := git(dir, "config", "user.name")
+	if err == nil && n != "" {
+		return n
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,225 @@
+package many
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// The default templates of git tag names.
+const (
+	DefaultReleaseTagTemplate = "product-{{.Release}}"
+	DefaultPromoteTagTemplate = "promoted-{{.Version}}"
+)
+
+// How git tags are created in services' repositories.
+type GitTagOptions struct {
+	// A text/template for tag names, given GitTagData.
+	Template string
+	// The tag message.
+	Message string
+	// Sign the tags with git's configured key.
+	Sign bool
+	// Report the tags that would be created without creating them.
+	DryRun bool
+	// The directory of mirrors of the services' git repositories. See
+	// DefaultMirrorDir.
+	Mirrors string
+}
+
+// The data given to tag name templates.
+type GitTagData struct {
+	// The Manyfile's name.
+	Name string
+	// The overall version. Empty when promoting.
+	Release string
+	Service string
+	Version string
+}
+
+// A git tag in a service's repository.
+type GitTag struct {
+	Service string    `json:"service" yaml:"service"`
+	Version string    `json:"version" yaml:"version"`
+	Commit  string    `json:"commit,omitempty" yaml:"commit,omitempty"`
+	Tag     string    `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Status  TagStatus `json:"status" yaml:"status"`
+	// Where the tag was created, for rolling back.
+	mirror string
+	remote string
+}
+
+// Tag the commit of each service's version in an overall version. Services
+// without a git repository are skipped. See tagRepos.
+func (m Manyfile) TagReleaseRepos(release string, opts GitTagOptions) ([]GitTag, error) {
+	v, err := m.FindRelease(release)
+	if err != nil {
+		return nil, err
+	}
+	var ds []GitTagData
+	ns := sortedKeys(func(add func(string)) {
+		for n := range v.Services {
+			add(n)
+		}
+	})
+	for _, n := range ns {
+		ds = append(ds, GitTagData{
+			Name:    m.Name,
+			Release: release,
+			Service: n,
+			Version: v.Services[n],
+		})
+	}
+	if opts.Message == "" {
+		opts.Message = fmt.Sprintf("Release %s of %s.", release, m.Name)
+	}
+	return m.tagRepos(ds, opts)
+}
+
+// Tag the commit of a service's version. See tagRepos.
+func (m Manyfile) TagServiceRepo(service string, version string, opts GitTagOptions) ([]GitTag, error) {
+	return m.tagRepos(
+		[]GitTagData{{Name: m.Name, Service: service, Version: version}},
+		opts,
+	)
+}
+
+// Create annotated git tags of services' versions and push them to the
+// services' repositories. All tags are checked before any is created, and if
+// one can't be pushed the tags already pushed are deleted again. Tags that
+// already point at the version are left as they are, tags that point
+// elsewhere are an error.
+func (m Manyfile) tagRepos(ds []GitTagData, opts GitTagOptions) ([]GitTag, error) {
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(opts.Template)
+	if err != nil {
+		return nil, err
+	}
+	// Plan the tags. Services may share a repository, so planned tags are
+	// checked as well as existing ones.
+	var ts []GitTag
+	planned := map[string]string{}
+	for _, d := range ds {
+		t := GitTag{Service: d.Service, Version: d.Version, Status: TagSkipped}
+		s, err := m.Service(d.Service)
+		if err != nil {
+			return nil, err
+		}
+		if s.Git == "" {
+			ts = append(ts, t)
+			continue
+		}
+		t.remote = s.Git
+		t.mirror, err = s.mirror(opts.Mirrors)
+		if err != nil {
+			return nil, err
+		}
+		t.Commit, err = resolveRevision(t.mirror, d.Service, d.Version)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		err = tmpl.Execute(&b, d)
+		if err != nil {
+			return nil, err
+		}
+		t.Tag = b.String()
+		_, err = git(t.mirror, "check-ref-format", "refs/tags/"+t.Tag)
+		if err != nil {
+			return nil, errorf(ErrInvalidVersion, "Invalid git tag name %q.", t.Tag)
+		}
+		// Check for an existing tag.
+		e, err := git(t.mirror, "rev-parse", "--quiet", "--verify", "refs/tags/"+t.Tag+"^{commit}")
+		p, isPlanned := planned[t.mirror+" "+t.Tag]
+		if isPlanned {
+			e, err = p, nil
+		}
+		switch {
+		case err == nil && e == t.Commit:
+			t.Status = TagUnchanged
+		case err == nil:
+			return nil, errorf(
+				ErrTagExists,
+				"Tag %s of service %s already exists on another commit.",
+				t.Tag,
+				d.Service,
+			)
+		default:
+			t.Status = TagPlanned
+			planned[t.mirror+" "+t.Tag] = t.Commit
+		}
+		ts = append(ts, t)
+	}
+	if opts.DryRun {
+		return ts, nil
+	}
+	// Create and push the tags.
+	for i, t := range ts {
+		if t.Status != TagPlanned {
+			continue
+		}
+		err := createTag(t, opts)
+		if err != nil {
+			return nil, RollbackGitTags(ts[:i], err)
+		}
+		ts[i].Status = TagCreated
+	}
+	return ts, nil
+}
+
+// Create a tag in a mirror and push it to the service's repository.
+func createTag(t GitTag, opts GitTagOptions) error {
+	args := []string{"tag", "--annotate"}
+	if opts.Sign {
+		args = []string{"tag", "--sign"}
+	}
+	msg := opts.Message
+	if msg == "" {
+		msg = fmt.Sprintf("Version %s of %s.", t.Version, t.Service)
+	}
+	args = append(args, "--message", msg, t.Tag, t.Commit)
+	_, err := git(t.mirror, args...)
+	if err != nil {
+		return err
+	}
+	// Push to the URL, pushing to a mirror's remote pushes every ref.
+	_, err = git(t.mirror, "push", "--quiet", t.remote, "refs/tags/"+t.Tag)
+	if err != nil {
+		// Best effort, the mirror is updated from the remote anyway.
+		git(t.mirror, "tag", "--delete", t.Tag)
+		return err
+	}
+	return nil
+}
+
+// Delete the tags that were created before a failure, such as failing to
+// save the release they were created for. Returns the failure, noting any
+// tags that couldn't be deleted.
+func RollbackGitTags(ts []GitTag, cause error) error {
+	var left []string
+	for _, t := range ts {
+		if t.Status != TagCreated {
+			continue
+		}
+		_, err := git(t.mirror, "push", "--quiet", t.remote, ":refs/tags/"+t.Tag)
+		if err != nil {
+			left = append(left, t.Service+" "+t.Tag)
+			continue
+		}
+		git(t.mirror, "tag", "--delete", t.Tag)
+	}
+	if len(left) == 0 {
+		return cause
+	}
+	kind := ErrGit
+	var e *Error
+	if errors.As(cause, &e) {
+		kind = e.Kind
+	}
+	return errorf(
+		kind,
+		"%s Tags couldn't be rolled back: %s.",
+		cause,
+		strings.Join(left, ", "),
+	)
+}
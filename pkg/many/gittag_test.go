@@ -0,0 +1,132 @@
+package many
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Create a bare repository for a service, with a commit tagged v1.0.0.
+func testServiceRemote(t *testing.T) string {
+	t.Helper()
+	remote := testRemote(t)
+	work := testTempDir(t)
+	testGit(t, work, "init", "--quiet")
+	testGit(t, work, "commit", "--quiet", "--allow-empty", "-m", "feat: first")
+	testGit(t, work, "tag", "v1.0.0")
+	testGit(t, work, "push", "--quiet", remote, "HEAD:refs/heads/master", "refs/tags/v1.0.0")
+	return remote
+}
+
+// Make a bare repository refuse pushes, or accept them again.
+func testRefusePushes(t *testing.T, remote string, refuse bool) {
+	t.Helper()
+	p := filepath.Join(remote, "hooks", "pre-receive")
+	if !refuse {
+		err := os.Remove(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	err := ioutil.WriteFile(p, []byte("#!/bin/sh\necho refused >&2\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check if a repository has a tag.
+func testHasTag(t *testing.T, repo string, tag string) bool {
+	t.Helper()
+	return testGit(t, repo, "tag", "--list", tag) == tag
+}
+
+// A Manyfile releasing two services from their repositories.
+func testTagManyfile(api string, web string) Manyfile {
+	return Manyfile{
+		Name: "product",
+		Services: Services{
+			"api": {Name: "api", Git: api},
+			"web": {Name: "web", Git: web},
+		},
+		Versions: Versions{{
+			Name:     "v1.0.0",
+			Services: map[string]string{"api": "1.0.0", "web": "1.0.0"},
+		}},
+	}
+}
+
+func TestTagReleaseReposRollback(t *testing.T) {
+	api, web := testServiceRemote(t), testServiceRemote(t)
+	m := testTagManyfile(api, web)
+	opts := GitTagOptions{Template: DefaultReleaseTagTemplate, Mirrors: testTempDir(t)}
+	// The api tag is pushed, then web refuses its tag.
+	testRefusePushes(t, web, true)
+	_, err := m.TagReleaseRepos("v1.0.0", opts)
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("got error %v, want web's refusal", err)
+	}
+	for _, r := range []string{api, web} {
+		if testHasTag(t, r, "product-v1.0.0") {
+			t.Errorf("%s has the tag", r)
+		}
+	}
+	// Once web accepts it, both are tagged, and tagging again changes
+	// nothing.
+	testRefusePushes(t, web, false)
+	ts, err := m.TagReleaseRepos("v1.0.0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range ts {
+		if tag.Status != TagCreated || tag.Tag != "product-v1.0.0" {
+			t.Errorf("got tag %+v, want it created", tag)
+		}
+	}
+	ts, err = m.TagReleaseRepos("v1.0.0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range ts {
+		if tag.Status != TagUnchanged {
+			t.Errorf("got tag %+v, want it unchanged", tag)
+		}
+	}
+}
+
+func TestRollbackGitTags(t *testing.T) {
+	api, web := testServiceRemote(t), testServiceRemote(t)
+	m := testTagManyfile(api, web)
+	opts := GitTagOptions{Template: DefaultReleaseTagTemplate, Mirrors: testTempDir(t)}
+	ts, err := m.TagReleaseRepos("v1.0.0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Saving the release failed, so the tags are deleted.
+	cause := errorf(ErrConcurrentChange, "Manyfile changed.")
+	err = RollbackGitTags(ts, cause)
+	if err != cause {
+		t.Errorf("got error %v, want the cause", err)
+	}
+	for _, r := range []string{api, web} {
+		if testHasTag(t, r, "product-v1.0.0") {
+			t.Errorf("%s still has the tag", r)
+		}
+	}
+	// Tags that can't be deleted are reported, with the cause's kind.
+	ts, err = m.TagReleaseRepos("v1.0.0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRefusePushes(t, web, true)
+	err = RollbackGitTags(ts, cause)
+	if !errors.Is(err, ErrConcurrentChange) || err == cause {
+		t.Errorf("got error %v, want one noting web's tag", err)
+	}
+	if testHasTag(t, api, "product-v1.0.0") || !testHasTag(t, web, "product-v1.0.0") {
+		t.Error("got the wrong tags deleted")
+	}
+}
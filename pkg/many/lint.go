@@ -0,0 +1,334 @@
+package many
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// How serious a lint problem is.
+type Severity int
+
+const (
+	// The Manyfile is valid but probably not what was intended.
+	SeverityWarning Severity = iota
+	// The Manyfile is inconsistent and commands may misbehave.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// A problem found in a Manyfile.
+type Problem struct {
+	Severity Severity
+	// Where the problem is, for example "services.backend.versions[2]".
+	Path    string
+	Message string
+	// Whether the problem was fixed.
+	Fixed bool
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s: %s: %s", p.Path, p.Severity, p.Message)
+	if p.Fixed {
+		s += " (fixed)"
+	}
+	return s
+}
+
+// The problems found in a Manyfile.
+type Problems []Problem
+
+// Check if any problem that wasn't fixed is an error.
+func (ps Problems) HasErrors() bool {
+	for _, p := range ps {
+		if p.Severity == SeverityError && !p.Fixed {
+			return true
+		}
+	}
+	return false
+}
+
+// The state of a lint.
+type linter struct {
+	fix      bool
+	problems Problems
+}
+
+// Record a problem.
+func (l *linter) report(
+	severity Severity,
+	fixed bool,
+	p string,
+	format string,
+	args ...interface{},
+) {
+	l.problems = append(l.problems, Problem{
+		Severity: severity,
+		Path:     p,
+		Message:  fmt.Sprintf(format, args...),
+		Fixed:    fixed,
+	})
+}
+
+// Check a Manyfile for problems that decoding doesn't catch, such as
+// duplicate versions or releases of unknown services. If fix is set, problems
+// that can be fixed without losing information are fixed: exact duplicate
+// versions are removed, versions and deployments are sorted and missing
+// service and environment names are filled in from their keys.
+func (m *Manyfile) Lint(fix bool) Problems {
+	l := linter{fix: fix}
+	if m.Name == "" {
+		l.report(SeverityWarning, false, "name", "The Manyfile has no name.")
+	}
+	// Services, in a stable order.
+	names := sortedKeys(func(add func(string)) {
+		for n := range m.Services {
+			add(n)
+		}
+	})
+	for i, n := range names {
+		s := m.Services[n]
+		l.service("services."+n, n, &s)
+		m.Services[n] = s
+		// Names that differ only by case are easily confused.
+		for _, o := range names[:i] {
+			if strings.EqualFold(n, o) {
+				l.report(
+					SeverityError,
+					false,
+					"services."+n,
+					"Service %s collides with service %s.",
+					n,
+					o,
+				)
+			}
+		}
+	}
+	// Overall versions.
+	l.versions("versions", &m.Versions)
+	for i, v := range m.Versions {
+		p := fmt.Sprintf("versions[%d]", i)
+		if _, err := ParseSemver(v.Name); v.Name != "" && err != nil {
+			l.report(
+				SeverityWarning,
+				false,
+				p,
+				"Overall version %s is not a semantic version.",
+				v.Name,
+			)
+		}
+		l.release(p, v, m.Services)
+	}
+	if _, ok := m.Versions.Find(m.CurrentRelease); m.CurrentRelease != "" && !ok {
+		l.report(
+			SeverityError,
+			false,
+			"current_release",
+			"Current release %s is not an overall version.",
+			m.CurrentRelease,
+		)
+	}
+	// Environments, in a stable order.
+	names = sortedKeys(func(add func(string)) {
+		for n := range m.Environments {
+			add(n)
+		}
+	})
+	for _, n := range names {
+		e := m.Environments[n]
+		l.environment("environments."+n, n, &e, m.Versions)
+		m.Environments[n] = e
+	}
+	return l.problems
+}
+
+// Check a service.
+func (l *linter) service(p string, key string, s *Service) {
+	switch {
+	case s.Name == "":
+		l.report(SeverityError, l.fix, p+".name", "Service %s has no name.", key)
+		if l.fix {
+			s.Name = key
+		}
+	case s.Name != key:
+		l.report(
+			SeverityError,
+			false,
+			p+".name",
+			"Service name %s doesn't match its key %s.",
+			s.Name,
+			key,
+		)
+	}
+	if err := validateServiceName(key); err != nil {
+		l.report(SeverityError, false, p, "%s", err)
+	}
+	if s.Git != "" {
+		if err := validateGitURL(s.Git); err != nil {
+			l.report(SeverityWarning, false, p+".git", "%s", err)
+		}
+	}
+	if s.Docker != "" {
+		if err := validateDockerRepo(s.Docker); err != nil {
+			l.report(SeverityWarning, false, p+".docker", "%s", err)
+		}
+	}
+	// The candidate.
+	c := s.Candidate
+	switch {
+	case c.Name == "" && !c.Equal(Version{}):
+		l.report(SeverityWarning, false, p+".candidate", "Candidate has details but no name.")
+	case c.Name != "" && c.Date.IsZero():
+		l.report(SeverityWarning, false, p+".candidate", "Candidate %s has no date.", c.Name)
+	}
+	if e, ok := s.Versions.Find(c.Name); c.Name != "" && ok && !sameContent(e, c) {
+		l.report(
+			SeverityWarning,
+			false,
+			p+".candidate",
+			"Candidate %s differs from the version of the same name and can't be "+
+				"promoted.",
+			c.Name,
+		)
+	}
+	// The versions.
+	l.versions(p+".versions", &s.Versions)
+	for i, v := range s.Versions {
+		if len(v.Services) > 0 {
+			l.report(
+				SeverityWarning,
+				false,
+				fmt.Sprintf("%s.versions[%d]", p, i),
+				"Service version %s has services.",
+				v.Name,
+			)
+		}
+	}
+}
+
+// Check an environment's name and its deployments.
+func (l *linter) environment(p string, key string, e *Environment, releases Versions) {
+	switch {
+	case e.Name == "":
+		l.report(SeverityError, l.fix, p+".name", "Environment %s has no name.", key)
+		if l.fix {
+			e.Name = key
+		}
+	case e.Name != key:
+		l.report(
+			SeverityError,
+			false,
+			p+".name",
+			"Environment name %s doesn't match its key %s.",
+			e.Name,
+			key,
+		)
+	}
+	for i, d := range e.Deployments {
+		dp := fmt.Sprintf("%s.deployments[%d]", p, i)
+		if d.Date.IsZero() {
+			l.report(SeverityWarning, false, dp, "Deployment of %s has no date.", d.Release)
+		}
+		if _, ok := releases.Find(d.Release); !ok {
+			l.report(
+				SeverityWarning,
+				false,
+				dp,
+				"Deployment of unknown overall version %s.",
+				d.Release,
+			)
+		}
+	}
+	if !sort.IsSorted(e.Deployments) {
+		l.report(SeverityWarning, l.fix, p+".deployments", "Deployments are not in order.")
+		if l.fix {
+			sort.Stable(e.Deployments)
+		}
+	}
+}
+
+// Check a collection of versions for missing names and dates, duplicates and
+// order.
+func (l *linter) versions(p string, vs *Versions) {
+	seen := map[string]Version{}
+	kept := Versions{}
+	for i, v := range *vs {
+		vp := fmt.Sprintf("%s[%d]", p, i)
+		if v.Name == "" {
+			l.report(SeverityError, false, vp, "Version has no name.")
+		}
+		if v.Date.IsZero() {
+			l.report(SeverityWarning, false, vp, "Version %s has no date.", v.Name)
+		}
+		// Duplicates. Exact duplicates can be removed safely.
+		if e, ok := seen[v.Name]; ok && v.Name != "" {
+			if e.Equal(v) {
+				l.report(SeverityError, l.fix, vp, "Version %s is duplicated.", v.Name)
+				if l.fix {
+					continue
+				}
+			} else {
+				l.report(
+					SeverityError,
+					false,
+					vp,
+					"Version %s is duplicated with different details.",
+					v.Name,
+				)
+			}
+		} else {
+			seen[v.Name] = v
+		}
+		kept = append(kept, v)
+	}
+	if l.fix {
+		*vs = kept
+	}
+	// Order.
+	if !sort.IsSorted(*vs) {
+		l.report(SeverityWarning, l.fix, p, "Versions are not in order.")
+		if l.fix {
+			sort.Stable(*vs)
+		}
+	}
+}
+
+// Check that an overall version's services and their versions exist.
+func (l *linter) release(p string, v Version, services Services) {
+	names := sortedKeys(func(add func(string)) {
+		for n := range v.Services {
+			add(n)
+		}
+	})
+	for _, n := range names {
+		s, ok := services[n]
+		if !ok {
+			l.report(
+				SeverityError,
+				false,
+				p+".services."+n,
+				"Overall version %s has unknown service %s.",
+				v.Name,
+				n,
+			)
+			continue
+		}
+		if _, ok := s.Versions.Find(v.Services[n]); !ok {
+			l.report(
+				SeverityWarning,
+				false,
+				p+".services."+n,
+				"Overall version %s has unknown version %s of service %s.",
+				v.Name,
+				v.Services[n],
+				n,
+			)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package many
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The name of the lock file in a repo dir that isn't a git repository. It is
+// excluded from git when the git repository is created.
+const LockFile = ".many.lock"
+
+// The name of the lock file in the git dir of a repo that is a git
+// repository, out of the work tree.
+const gitLockFile = "many.lock"
+
+// How often to try a held lock while waiting for it.
+var lockPollInterval = 100 * time.Millisecond
+
+// An advisory lock on a repo dir, held while loading, changing and saving
+// the repo so concurrent invocations don't overwrite each other. The lock is
+// an OS file lock on the lock file, so it is released when the holder exits,
+// however it exits. The file is left in place.
+type Lock struct {
+	file *os.File
+}
+
+// The holder of a lock, recorded in the lock file for error messages. The
+// record is left behind if the holder exits without unlocking, and the lock
+// may be held by a process that doesn't record itself, such as flock(1).
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Created time.Time `json:"created"`
+}
+
+// Acquire the lock on a repo dir, waiting up to the timeout for another
+// holder to release it.
+func LockRepo(repo string, timeout time.Duration) (*Lock, error) {
+	err := os.MkdirAll(repo, 0755)
+	if err != nil {
+		return nil, err
+	}
+	p := lockPath(repo)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		// Wait for the holder to release it.
+		if time.Now().After(deadline) {
+			f.Close()
+			h, err := readLockHolder(p)
+			if err != nil || !h.alive() {
+				return nil, errorf(ErrLocked, "Repository is locked by another process.")
+			}
+			return nil, errorf(
+				ErrLocked,
+				"Repository is locked by process %d on %s since %s.",
+				h.PID,
+				h.Host,
+				h.Created.Format(time.RFC3339),
+			)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	// Record the holder. The lock is held even if this fails.
+	host, _ := os.Hostname()
+	b, _ := json.Marshal(lockHolder{
+		PID:     os.Getpid(),
+		Host:    host,
+		Created: time.Now().UTC(),
+	})
+	if f.Truncate(0) == nil {
+		f.WriteAt(b, 0)
+	}
+	return &Lock{file: f}, nil
+}
+
+// Release the lock. The holder's record is cleared first, so it isn't
+// mistaken for the holder of a lock taken by something else.
+func (l *Lock) Unlock() error {
+	l.file.Truncate(0)
+	err := unlockFile(l.file)
+	cerr := l.file.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Run a function while holding the lock on a repo dir.
+func WithLock(repo string, timeout time.Duration, fn func() error) error {
+	l, err := LockRepo(repo, timeout)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	uerr := l.Unlock()
+	if err != nil {
+		return err
+	}
+	return uerr
+}
+
+// Get the path of a repo dir's lock file, in its git dir if it is a git
+// repository.
+func lockPath(repo string) string {
+	if isGitRepo(repo) {
+		d, err := git(repo, "rev-parse", "--git-dir")
+		if err == nil {
+			if !filepath.IsAbs(d) {
+				d = filepath.Join(repo, d)
+			}
+			return filepath.Join(d, gitLockFile)
+		}
+	}
+	return filepath.Join(repo, LockFile)
+}
+
+// Exclude the lock file of a repo dir that wasn't a git repository from git,
+// so it isn't committed.
+func excludeLockFile(repo string) error {
+	p, err := git(repo, "rev-parse", "--git-path", "info/exclude")
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(repo, p)
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	pattern := "/" + LockFile
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(l) == pattern {
+			return nil
+		}
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		pattern = "\n" + pattern
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(pattern + "\n")
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Check if a recorded holder may still hold the lock. Processes on other
+// hosts can't be checked.
+func (h lockHolder) alive() bool {
+	if h.PID <= 0 {
+		return false
+	}
+	host, _ := os.Hostname()
+	return h.Host != host || processExists(h.PID)
+}
+
+// Read the holder of a lock. Fields are empty if it can't be read.
+func readLockHolder(path string) (lockHolder, error) {
+	var h lockHolder
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return h, err
+	}
+	return h, json.Unmarshal(b, &h)
+}
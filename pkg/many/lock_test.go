@@ -0,0 +1,130 @@
+package many
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockOutsideWorkTree(t *testing.T) {
+	remote := testRemote(t)
+	repo := filepath.Join(testTempDir(t), "repo")
+	// Initialise the repo while holding its lock, as init does.
+	err := WithLock(repo, 0, func() error {
+		_, err := InitRepo(repo, DefaultManyfile, "product", remote, "origin", false, false)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lock taken before the git repository existed is excluded.
+	out := testGit(t, repo, "status", "--porcelain", "--untracked-files=all")
+	if out != "?? "+DefaultManyfile {
+		t.Errorf("got status %q, want only the Manyfile untracked", out)
+	}
+	// Once it is a git repository, the lock is in the git dir.
+	err = os.Remove(filepath.Join(repo, LockFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := LockRepo(repo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Unlock()
+	if _, err := os.Stat(filepath.Join(repo, ".git", gitLockFile)); err != nil {
+		t.Errorf("lock file isn't in the git dir: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, LockFile)); !os.IsNotExist(err) {
+		t.Error("lock file is in the work tree")
+	}
+	// Excluding it again doesn't repeat the pattern.
+	err = excludeLockFile(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(repo, ".git", "info", "exclude"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "/"+LockFile+"\n"); n != 1 {
+		t.Errorf("lock file is excluded %d times", n)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	repo := testTempDir(t)
+	l, err := LockRepo(repo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The holder is named while it is alive.
+	start := time.Now()
+	_, err = LockRepo(repo, 150*time.Millisecond)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("got error %v, want ErrLocked", err)
+	}
+	if time.Since(start) < 150*time.Millisecond {
+		t.Error("didn't wait for the timeout")
+	}
+	if want := fmt.Sprintf("process %d", os.Getpid()); !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to name %s", err, want)
+	}
+	err = l.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Released, it can be taken again.
+	l, err = LockRepo(repo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockHolderExited(t *testing.T) {
+	repo := testTempDir(t)
+	// A holder that exited without unlocking left its record.
+	cmd := exec.Command("git", "--version")
+	err := cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	b, err := json.Marshal(lockHolder{PID: cmd.Process.Pid, Host: host, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := lockPath(repo)
+	err = ioutil.WriteFile(p, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Something that doesn't record itself holds the lock.
+	f, err := os.OpenFile(p, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ok, err := tryLockFile(f)
+	if err != nil || !ok {
+		t.Fatalf("couldn't lock: %v", err)
+	}
+	_, err = LockRepo(repo, 0)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("got error %v, want ErrLocked", err)
+	}
+	if strings.Contains(err.Error(), fmt.Sprint(cmd.Process.Pid)) {
+		t.Errorf("got error %q, naming the exited process", err)
+	}
+}
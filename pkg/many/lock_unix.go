@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package many
+
+import (
+	"os"
+	"syscall"
+)
+
+// Try to take an exclusive lock on a file without waiting. Returns false if
+// another process holds it.
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Check if a process exists.
+func processExists(pid int) bool {
+	// Signal 0 checks for the process without signalling it. EPERM means it
+	// exists but belongs to another user.
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Release a lock on a file.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,70 @@
+//go:build windows
+// +build windows
+
+package many
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// Try to take an exclusive lock on a file without waiting. Returns false if
+// another process holds it.
+func tryLockFile(f *os.File) (bool, error) {
+	var o syscall.Overlapped
+	r, _, err := procLockFileEx.Call(
+		f.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&o)),
+	)
+	if r != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
+
+// Check if a process exists.
+func processExists(pid int) bool {
+	// Finding a process fails on Windows if it doesn't exist.
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// Release a lock on a file.
+func unlockFile(f *os.File) error {
+	var o syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(
+		f.Fd(),
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&o)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,719 @@
+// Package many manages Many repositories. A Many repository is a git
+// repository holding a Manyfile, which records the versions of a collection
+// of services and the overall versions of the product they make up.
+package many
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A version of a service, or an overall version of all services.
+type Version struct {
+	Name        string    `toml:"name" json:"name" yaml:"name"`
+	Description string    `toml:"description" json:"description" yaml:"description"`
+	Date        time.Time `toml:"date" json:"date" yaml:"date"`
+	Author      string    `toml:"author" json:"author" yaml:"author"`
+	// The digest of the service's Docker image for this version, recorded
+	// when the image is verified. Empty for overall versions.
+	Digest string `toml:"digest,omitempty" json:"digest,omitempty" yaml:"digest,omitempty"`
+	// The version of each service in an overall version. The key is the
+	// service's name. Empty for service versions, and for overall versions
+	// recorded before releases recorded their services.
+	Services map[string]string `toml:"services,omitempty" json:"services,omitempty" yaml:"services,omitempty"`
+	// Whether an overall version can't be rolled back past, for example
+	// because it migrates a database.
+	Incompatible bool `toml:"incompatible,omitempty" json:"incompatible,omitempty" yaml:"incompatible,omitempty"`
+}
+
+// A collection of versions.
+type Versions []Version
+
+// A service.
+type Service struct {
+	Name        string   `toml:"name" json:"name" yaml:"name"`
+	Description string   `toml:"description" json:"description" yaml:"description"`
+	Git         string   `toml:"git" json:"git" yaml:"git"`
+	Docker      string   `toml:"docker" json:"docker" yaml:"docker"`
+	Candidate   Version  `toml:"candidate" json:"candidate" yaml:"candidate"`
+	Versions    Versions `toml:"versions" json:"versions" yaml:"versions"`
+}
+
+// A table of services. The key is the service's name.
+type Services map[string]Service
+
+// A deployment of an overall version to an environment.
+type Deployment struct {
+	Release string    `toml:"release" json:"release" yaml:"release"`
+	Date    time.Time `toml:"date" json:"date" yaml:"date"`
+	Author  string    `toml:"author" json:"author" yaml:"author"`
+	// The version of each service deployed, from the overall version. The key
+	// is the service's name.
+	Services map[string]string `toml:"services,omitempty" json:"services,omitempty" yaml:"services,omitempty"`
+}
+
+// The deployments to an environment, oldest first.
+type Deployments []Deployment
+
+// An environment that overall versions are deployed to, such as staging.
+type Environment struct {
+	Name        string      `toml:"name" json:"name" yaml:"name"`
+	Description string      `toml:"description" json:"description" yaml:"description"`
+	Deployments Deployments `toml:"deployments" json:"deployments" yaml:"deployments"`
+}
+
+// A table of environments. The key is the environment's name.
+type Environments map[string]Environment
+
+// The Manyfile is the config containing the versioning information. It is
+// written in TOML, JSON or YAML, see Codec.
+type Manyfile struct {
+	// The version of the Manyfile format. See SchemaVersion.
+	SchemaVersion int      `toml:"schema_version" json:"schema_version" yaml:"schema_version"`
+	Name          string   `toml:"name" json:"name" yaml:"name"`
+	RemoteURL     string   `toml:"remote_url" json:"remote_url" yaml:"remote_url"`
+	RemoteName    string   `toml:"remote_name" json:"remote_name" yaml:"remote_name"`
+	Versions      Versions `toml:"versions" json:"versions" yaml:"versions"`
+	Services      Services `toml:"services" json:"services" yaml:"services"`
+	// Added in schema version 4.
+	Environments Environments `toml:"environments,omitempty" json:"environments,omitempty" yaml:"environments,omitempty"`
+	// The overall version the product was rolled back to. Empty when the
+	// latest release is current. Added in schema version 5.
+	CurrentRelease string `toml:"current_release,omitempty" json:"current_release,omitempty" yaml:"current_release,omitempty"`
+}
+
+// A Many repository.
+type Repo struct {
+	Path     string
+	File     string
+	ManyFile Manyfile
+	// A digest of the Manyfile as it was loaded or last saved. Nil if it
+	// didn't exist.
+	digest []byte
+}
+
+// Part of the sort interface.
+func (vs Versions) Len() int {
+	return len(vs)
+}
+
+// Part of the sort interface.
+func (vs Versions) Swap(i, j int) {
+	vs[i], vs[j] = vs[j], vs[i]
+}
+
+// Part of the sort interface. See CompareVersions for the order.
+func (vs Versions) Less(i, j int) bool {
+	return CompareVersions(vs[i], vs[j]) < 0
+}
+
+// Compare versions. Returns -1, 0 or 1 if the first version is ordered
+// before, with or after the second. Semantic versions are ordered by
+// precedence. Other names, such as git SHAs, are ordered by date and come
+// before semantic versions. Ties are broken by name.
+func CompareVersions(v1 Version, v2 Version) int {
+	s1, err1 := ParseSemver(v1.Name)
+	s2, err2 := ParseSemver(v2.Name)
+	switch {
+	// Both semantic versions.
+	case err1 == nil && err2 == nil:
+		if c := s1.Compare(s2); c != 0 {
+			return c
+		}
+	// Neither semantic versions.
+	case err1 != nil && err2 != nil:
+		if v1.Date.Before(v2.Date) {
+			return -1
+		}
+		if v1.Date.After(v2.Date) {
+			return 1
+		}
+	// Only one semantic version.
+	case err1 != nil:
+		return -1
+	default:
+		return 1
+	}
+	return strings.Compare(v1.Name, v2.Name)
+}
+
+// Add a version to a collection of versions, keeping it sorted.
+func (vs *Versions) Add(v Version) {
+	// Search for the version to be added.
+	i := 0
+	for i < len(*vs) && (*vs)[i].Name != v.Name {
+		i++
+	}
+	// The version already exists in the collection.
+	if i < len(*vs) {
+		// Override the version.
+		(*vs)[i] = v
+		// The version does not exist in the collection.
+	} else {
+		// Insert the version.
+		*vs = append(*vs, v)
+	}
+	sort.Stable(*vs)
+}
+
+// Find a version by name.
+func (vs Versions) Find(name string) (Version, bool) {
+	for _, v := range vs {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Version{}, false
+}
+
+// Get the version of a service in an overall version.
+func (v Version) ServiceVersion(service string) (string, bool) {
+	sv, ok := v.Services[service]
+	return sv, ok
+}
+
+// Merge versions. The service versions are merged per service.
+func (v1 *Version) Merge(v2 Version) error {
+	if v2.Name != "" {
+		v1.Name = v2.Name
+	}
+	if v2.Description != "" {
+		v1.Description = v2.Description
+	}
+	if !v2.Date.IsZero() {
+		v1.Date = v2.Date
+	}
+	if v2.Author != "" {
+		v1.Author = v2.Author
+	}
+	if v2.Digest != "" {
+		v1.Digest = v2.Digest
+	}
+	if v2.Incompatible {
+		v1.Incompatible = true
+	}
+	if v2.Services != nil {
+		if v1.Services == nil {
+			v1.Services = map[string]string{}
+		}
+		for n, sv := range v2.Services {
+			v1.Services[n] = sv
+		}
+	}
+	return nil
+}
+
+// Merge a version into a collection of versions. A version with the same
+// name is merged with it, otherwise the version is added.
+func (vs *Versions) Merge(v Version) error {
+	for i := range *vs {
+		if (*vs)[i].Name == v.Name {
+			return (*vs)[i].Merge(v)
+		}
+	}
+	vs.Add(v)
+	return nil
+}
+
+// Merge services.
+func (s1 *Service) Merge(s2 Service) error {
+	if s2.Name != "" {
+		s1.Name = s2.Name
+	}
+	if s2.Description != "" {
+		s1.Description = s2.Description
+	}
+	if s2.Git != "" {
+		s1.Git = s2.Git
+	}
+	if s2.Docker != "" {
+		s1.Docker = s2.Docker
+	}
+	if !s2.Candidate.Equal(Version{}) {
+		s1.Candidate = s2.Candidate
+	}
+	if s2.Versions != nil {
+		for _, v := range s2.Versions {
+			err := s1.Versions.Merge(v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Merge Manyfiles.
+func (f1 *Manyfile) Merge(f2 Manyfile) error {
+	if f2.Name != "" {
+		f1.Name = f2.Name
+	}
+	if f2.RemoteURL != "" {
+		f1.RemoteURL = f2.RemoteURL
+	}
+	if f2.RemoteName != "" {
+		f1.RemoteName = f2.RemoteName
+	}
+	if f2.Versions != nil {
+		for _, f := range f2.Versions {
+			err := f1.Versions.Merge(f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if f2.Services != nil {
+		if f1.Services == nil {
+			f1.Services = Services{}
+		}
+		for n, s2 := range f2.Services {
+			s1, ok := f1.Services[n]
+			if !ok {
+				f1.Services[n] = s2
+				continue
+			}
+			err := s1.Merge(s2)
+			if err != nil {
+				return err
+			}
+			f1.Services[n] = s1
+		}
+	}
+	if f2.Environments != nil {
+		if f1.Environments == nil {
+			f1.Environments = Environments{}
+		}
+		for n, e2 := range f2.Environments {
+			e1 := f1.Environments[n]
+			if e2.Name != "" {
+				e1.Name = e2.Name
+			}
+			if e2.Description != "" {
+				e1.Description = e2.Description
+			}
+			e1.Deployments = mergeDeployments(e1.Deployments, e2.Deployments)
+			f1.Environments[n] = e1
+		}
+	}
+	if f2.CurrentRelease != "" {
+		f1.CurrentRelease = f2.CurrentRelease
+	}
+	return nil
+}
+
+// Create a repo struct. The Manyfile's path is relative to the repo path.
+func NewRepo(repo string, file string, m Manyfile) *Repo {
+	// Clean the repo path.
+	repo = filepath.Clean(repo)
+	return &Repo{
+		Path:     repo,
+		File:     filepath.Join(repo, file),
+		ManyFile: m,
+	}
+}
+
+// Save the repo.
+func (r *Repo) Save() error {
+	// Check if the repo dir exists.
+	_, err := os.Stat(r.Path)
+	if err != nil {
+		// The repo dir exists and there was an error.
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// Repo dir doesn't exist. Make the repo dir.
+		err = os.MkdirAll(r.Path, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	// Encode the Manyfile before touching the file, so an encoding error
+	// leaves it as it was.
+	c, err := CodecFor(r.File)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	err = EncodeManyfile(&b, c, r.ManyFile)
+	if err != nil {
+		return err
+	}
+	// Check the Manyfile hasn't been changed by someone else.
+	d, err := fileDigest(r.File)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(d, r.digest) {
+		return errorf(
+			ErrConcurrentChange,
+			"%s has changed since it was loaded. Load it again and retry.",
+			r.File,
+		)
+	}
+	// Write the Manyfile.
+	err = writeFileAtomic(r.File, b.Bytes())
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b.Bytes())
+	r.digest = sum[:]
+	return nil
+}
+
+// Accept the Manyfile as it is on disk as the loaded version, without
+// reloading it. Used when something else, such as git, is known to have
+// changed it.
+func (r *Repo) track() error {
+	d, err := fileDigest(r.File)
+	if err != nil {
+		return err
+	}
+	r.digest = d
+	return nil
+}
+
+// Get a digest of a file's content. Nil if it doesn't exist.
+func fileDigest(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// Write a file by writing a temporary file in the same directory and
+// renaming it over the original. Readers see either the old or the new file,
+// never a partial one, even if the process dies. The original's permissions
+// are kept.
+func writeFileAtomic(path string, data []byte) error {
+	// Keep the permissions of an existing file.
+	perm := os.FileMode(0644)
+	fi, err := os.Stat(path)
+	if err == nil {
+		perm = fi.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// Write and sync the temporary file.
+	dir, name := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Sync the directory so the rename is durable. Not all platforms support
+	// this, so errors are ignored.
+	if dir == "" {
+		dir = "."
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Load the repo.
+func LoadRepo(repo string, file string) (*Repo, error) {
+	r := NewRepo(repo, file, Manyfile{})
+	// Check if the repo dir exists.
+	_, err := os.Stat(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	// Check if the repo file exists.
+	_, err = os.Stat(r.File)
+	if err != nil {
+		return nil, err
+	}
+	// Decode the repo's Manyfile.
+	err = r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload the repo's Manyfile from disk.
+func (r *Repo) Reload() error {
+	b, err := ioutil.ReadFile(r.File)
+	if err != nil {
+		return err
+	}
+	c, err := CodecFor(r.File)
+	if err != nil {
+		return err
+	}
+	m, err := DecodeManyfile(c, b)
+	if err != nil {
+		return err
+	}
+	r.ManyFile = m
+	sum := sha256.Sum256(b)
+	r.digest = sum[:]
+	return nil
+}
+
+// Encode a Manyfile with the current schema version. Manyfiles with a newer
+// schema version are refused, since they may contain data this package
+// doesn't know about.
+func EncodeManyfile(w io.Writer, c Codec, m Manyfile) error {
+	if m.SchemaVersion > SchemaVersion {
+		return errorf(
+			ErrSchemaTooNew,
+			"Manyfile has schema version %d but only %d is supported. Upgrade many.",
+			m.SchemaVersion,
+			SchemaVersion,
+		)
+	}
+	m.SchemaVersion = SchemaVersion
+	return c.Encode(w, m)
+}
+
+// Decode a Manyfile, migrating it to the current schema version.
+func DecodeManyfile(c Codec, data []byte) (Manyfile, error) {
+	var m Manyfile
+	data, v, err := migrateData(c, data)
+	if err != nil {
+		return m, err
+	}
+	// Newer schema versions may have fields this version doesn't know, which
+	// strict codecs refuse. Read what is known, EncodeManyfile refuses to
+	// write it back.
+	if l, ok := c.(lenientCodec); ok && v > SchemaVersion {
+		err = l.decodeLenient(data, &m)
+		if err != nil {
+			return m, errorf(
+				ErrSchemaTooNew,
+				"Manyfile has schema version %d but only %d is supported. Upgrade many.",
+				v,
+				SchemaVersion,
+			)
+		}
+	} else {
+		err = c.Decode(data, &m)
+		if err != nil {
+			return m, err
+		}
+	}
+	// An empty table decodes as nil.
+	if m.Services == nil {
+		m.Services = Services{}
+	}
+	return m, nil
+}
+
+// The path taken when initialising a repo.
+type InitResult int
+
+const (
+	// A new Manyfile was created.
+	InitCreated InitResult = iota
+	// An existing Manyfile was cloned from the remote.
+	InitCloned
+	// The details of an existing repo were updated.
+	InitUpdated
+)
+
+// Initialise the repo.
+func InitRepo(
+	repo string,
+	file string,
+	name string,
+	remoteURL string,
+	remoteName string,
+	update bool,
+	noClone bool,
+) (InitResult, error) {
+	// Attempt to load an existing repo.
+	r, err := LoadRepo(repo, file)
+	if err != nil {
+		// Repo exists and there was an error loading it.
+		if !os.IsNotExist(err) {
+			return 0, err
+		}
+		// Repo does not exist. Make sure there is a git repository with the
+		// remote to clone from and push to.
+		err = initGitRepo(repo, remoteName, remoteURL)
+		if err != nil {
+			return 0, err
+		}
+		// Clone the remote's Manyfile, if there is one.
+		if !noClone {
+			cloned, err := cloneRemote(repo, remoteName)
+			if err != nil {
+				return 0, err
+			}
+			if cloned {
+				_, err = LoadRepo(repo, file)
+				if err == nil {
+					return InitCloned, nil
+				}
+				if !os.IsNotExist(err) {
+					return 0, err
+				}
+				// The remote has history but no Manyfile. Create it.
+			}
+		}
+		// Create the Manyfile.
+		r = NewRepo(
+			repo,
+			file,
+			Manyfile{
+				Name:       name,
+				RemoteURL:  remoteURL,
+				RemoteName: remoteName,
+				Versions:   Versions{},
+				Services:   Services{},
+			},
+		)
+		err = r.Save()
+		if err != nil {
+			return 0, err
+		}
+		return InitCreated, nil
+	}
+	// Repo exists, update it if flagged.
+	if !update {
+		return 0, errorf(
+			ErrRepoExists,
+			"Repository already exists. Use --update to update it.",
+		)
+	}
+	// Update the repo. Merge in the new repo details.
+	err = r.ManyFile.Merge(
+		Manyfile{
+			Name:       name,
+			RemoteURL:  remoteURL,
+			RemoteName: remoteName,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	// Save the updated repo.
+	err = r.Save()
+	if err != nil {
+		return 0, err
+	}
+	return InitUpdated, nil
+}
+
+// Make the repo dir a git repository with a remote.
+func initGitRepo(repo string, remoteName string, remoteURL string) error {
+	// Make the repo dir.
+	err := os.MkdirAll(repo, 0755)
+	if err != nil {
+		return err
+	}
+	// Initialise a git repository, unless there already is one.
+	if !isGitRepo(repo) {
+		_, err = git(repo, "init", "--quiet")
+		if err != nil {
+			return err
+		}
+	}
+	// The repo may have been locked before it was a git repository.
+	err = excludeLockFile(repo)
+	if err != nil {
+		return err
+	}
+	// Add the remote.
+	return ensureRemote(repo, remoteName, remoteURL)
+}
+
+// Check out the default branch of a remote. Returns false if the remote has
+// nothing to clone.
+func cloneRemote(repo string, remoteName string) (bool, error) {
+	// Find the branch to clone.
+	branch, err := remoteDefaultBranch(repo, remoteName)
+	if err != nil {
+		return false, err
+	}
+	// The remote is empty.
+	if branch == "" {
+		return false, nil
+	}
+	// Refuse to mix the remote's history with existing local history.
+	if hasCommits(repo) {
+		return false, errorf(
+			ErrHasHistory,
+			"Local git repository already has commits. Cannot clone into it.",
+		)
+	}
+	// Fetch and check out the branch.
+	_, err = git(repo, "fetch", "--quiet", remoteName, branch)
+	if err != nil {
+		return false, err
+	}
+	_, err = git(
+		repo,
+		"checkout",
+		"--quiet",
+		"-b",
+		branch,
+		"--track",
+		remoteName+"/"+branch,
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Load a repo, change its Manyfile and save it, holding the repo's lock
+// throughout. The timeout is how long to wait for the lock. Nothing is saved
+// if the change fails.
+func UpdateRepo(
+	repo string,
+	file string,
+	timeout time.Duration,
+	change func(m *Manyfile) error,
+) (*Repo, error) {
+	var r *Repo
+	err := WithLock(repo, timeout, func() error {
+		var err error
+		r, err = LoadRepo(repo, file)
+		if err != nil {
+			return err
+		}
+		err = change(&r.ManyFile)
+		if err != nil {
+			return err
+		}
+		return r.Save()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
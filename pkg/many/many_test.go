@@ -0,0 +1,313 @@
+package many
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The directory the tests' temporary directories are created in, removed
+// after the tests run.
+var testRoot string
+
+func TestMain(m *testing.M) {
+	// Commits made by the tests need an identity, whatever the host's git
+	// config.
+	os.Setenv("GIT_AUTHOR_NAME", "Tester")
+	os.Setenv("GIT_AUTHOR_EMAIL", "tester@example.com")
+	os.Setenv("GIT_COMMITTER_NAME", "Tester")
+	os.Setenv("GIT_COMMITTER_EMAIL", "tester@example.com")
+	var err error
+	testRoot, err = ioutil.TempDir("", "many-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c := m.Run()
+	os.RemoveAll(testRoot)
+	os.Exit(c)
+}
+
+// Create a temporary directory for a test.
+func testTempDir(t *testing.T) string {
+	t.Helper()
+	d, err := ioutil.TempDir(testRoot, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Run git in a directory, failing the test if it fails.
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := git(dir, args...)
+	if err != nil {
+		t.Fatalf("git %v: %s", args, err)
+	}
+	return out
+}
+
+// Create an empty bare repository to use as a remote.
+func testRemote(t *testing.T) string {
+	t.Helper()
+	p := filepath.Join(testTempDir(t), "remote.git")
+	testGit(t, filepath.Dir(p), "init", "--quiet", "--bare", p)
+	return p
+}
+
+func TestInitRepoEmptyRemote(t *testing.T) {
+	remote := testRemote(t)
+	repo := filepath.Join(testTempDir(t), "repo")
+	res, err := InitRepo(repo, DefaultManyfile, "product", remote, "origin", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != InitCreated {
+		t.Errorf("got result %v, want InitCreated", res)
+	}
+	r, err := LoadRepo(repo, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ManyFile.Name != "product" || r.ManyFile.RemoteURL != remote {
+		t.Errorf("got name %q and remote %q", r.ManyFile.Name, r.ManyFile.RemoteURL)
+	}
+	if u := testGit(t, repo, "remote", "get-url", "origin"); u != remote {
+		t.Errorf("got remote URL %q, want %q", u, remote)
+	}
+}
+
+func TestInitRepoClone(t *testing.T) {
+	remote := testRemote(t)
+	// Publish a Manyfile from one clone.
+	first := filepath.Join(testTempDir(t), "first")
+	_, err := InitRepo(first, DefaultManyfile, "product", remote, "origin", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = UpdateRepo(first, DefaultManyfile, 0, func(m *Manyfile) error {
+		_, err := m.CreateService(Service{Name: "api"}, false)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRepo(first, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Push("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Initialising another clone takes the remote's Manyfile.
+	second := filepath.Join(testTempDir(t), "second")
+	res, err := InitRepo(second, DefaultManyfile, "other", remote, "origin", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != InitCloned {
+		t.Errorf("got result %v, want InitCloned", res)
+	}
+	r, err = LoadRepo(second, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ManyFile.Name != "product" {
+		t.Errorf("got name %q, want the remote's", r.ManyFile.Name)
+	}
+	if _, ok := r.ManyFile.Services["api"]; !ok {
+		t.Error("remote's service api is missing")
+	}
+}
+
+func TestInitRepoNoClone(t *testing.T) {
+	remote := testRemote(t)
+	first := filepath.Join(testTempDir(t), "first")
+	_, err := InitRepo(first, DefaultManyfile, "product", remote, "origin", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRepo(first, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Push("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The remote has a Manyfile, but a new one is created.
+	second := filepath.Join(testTempDir(t), "second")
+	res, err := InitRepo(second, DefaultManyfile, "other", remote, "origin", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != InitCreated {
+		t.Errorf("got result %v, want InitCreated", res)
+	}
+	r, err = LoadRepo(second, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ManyFile.Name != "other" {
+		t.Errorf("got name %q, want other", r.ManyFile.Name)
+	}
+	if hasCommits(second) {
+		t.Error("remote's history was fetched")
+	}
+}
+
+func TestInitRepoHasHistory(t *testing.T) {
+	remote := testRemote(t)
+	first := filepath.Join(testTempDir(t), "first")
+	_, err := InitRepo(first, DefaultManyfile, "product", remote, "origin", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRepo(first, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Push("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A local repository with its own history can't take the remote's.
+	second := testTempDir(t)
+	testGit(t, second, "init", "--quiet")
+	testGit(t, second, "commit", "--quiet", "--allow-empty", "-m", "Unrelated")
+	_, err = InitRepo(second, DefaultManyfile, "other", remote, "origin", false, false)
+	if !errors.Is(err, ErrHasHistory) {
+		t.Fatalf("got error %v, want ErrHasHistory", err)
+	}
+	if _, err := os.Stat(filepath.Join(second, DefaultManyfile)); !os.IsNotExist(err) {
+		t.Error("Manyfile was created")
+	}
+}
+
+// Create a Many repo with a Manyfile, without git.
+func testRepo(t *testing.T) string {
+	t.Helper()
+	p := testTempDir(t)
+	err := NewRepo(p, DefaultManyfile, Manyfile{Name: "product"}).Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSaveConcurrentChange(t *testing.T) {
+	p := testRepo(t)
+	r1, err := LoadRepo(p, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRepo(p, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.ManyFile.Name = "first"
+	err = r1.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(r1.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second copy is stale.
+	r2.ManyFile.Name = "second"
+	err = r2.Save()
+	if !errors.Is(err, ErrConcurrentChange) {
+		t.Fatalf("got error %v, want ErrConcurrentChange", err)
+	}
+	b, err := ioutil.ReadFile(r2.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, saved) {
+		t.Errorf("Manyfile changed to %q", b)
+	}
+	// The first copy can still be saved.
+	r1.ManyFile.Name = "third"
+	err = r1.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveKeepsMode(t *testing.T) {
+	p := testRepo(t)
+	f := filepath.Join(p, DefaultManyfile)
+	err := os.Chmod(f, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRepo(p, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ManyFile.Name = "other"
+	err = r.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+// A codec that can't encode.
+type testFailingCodec struct {
+	JSONCodec
+}
+
+func (testFailingCodec) Encode(w io.Writer, v interface{}) error {
+	w.Write([]byte("{"))
+	return errors.New("encoding failed")
+}
+
+func TestSaveEncodeError(t *testing.T) {
+	RegisterCodec(".failing", testFailingCodec{})
+	defer delete(codecs, ".failing")
+	p := testTempDir(t)
+	f := filepath.Join(p, "Many.failing")
+	err := ioutil.WriteFile(f, []byte(`{"schema_version": 5, "name": "product"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRepo(p, "Many.failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ManyFile.Name = "other"
+	err = r.Save()
+	if err == nil {
+		t.Fatal("saving succeeded")
+	}
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"schema_version": 5, "name": "product"}` {
+		t.Errorf("Manyfile changed to %q", b)
+	}
+	// No temporary files are left behind.
+	fs, err := ioutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 {
+		t.Errorf("got %d files, want the Manyfile", len(fs))
+	}
+}
@@ -0,0 +1,413 @@
+package many
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A change to the same part of a Manyfile that was made differently on both
+// sides of a merge.
+type MergeConflict struct {
+	// Where the conflict is, for example "services.backend.candidate".
+	Path string
+	// The value in the common ancestor and on each side. Empty if absent.
+	Base   string
+	Ours   string
+	Theirs string
+}
+
+// The error returned when Manyfiles can't be merged without conflicts.
+type MergeConflictError struct {
+	Conflicts []MergeConflict
+}
+
+// Part of the errors.Is interface.
+func (e *MergeConflictError) Unwrap() error {
+	return ErrMergeConflict
+}
+
+func (e *MergeConflictError) Error() string {
+	var b strings.Builder
+	b.WriteString("Merge has conflicts:")
+	for _, c := range e.Conflicts {
+		fmt.Fprintf(
+			&b,
+			"\n  %s: base %s, ours %s, theirs %s",
+			c.Path,
+			describeValue(c.Base),
+			describeValue(c.Ours),
+			describeValue(c.Theirs),
+		)
+	}
+	return b.String()
+}
+
+// Describe a conflicting value for the conflict report.
+func describeValue(v string) string {
+	if v == "" {
+		return "<none>"
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+// Check if two versions are the same.
+func (v1 Version) Equal(v2 Version) bool {
+	if v1.Name != v2.Name ||
+		v1.Description != v2.Description ||
+		!v1.Date.Equal(v2.Date) ||
+		v1.Author != v2.Author ||
+		v1.Digest != v2.Digest ||
+		v1.Incompatible != v2.Incompatible ||
+		len(v1.Services) != len(v2.Services) {
+		return false
+	}
+	for n, sv := range v1.Services {
+		if v2.Services[n] != sv {
+			return false
+		}
+	}
+	return true
+}
+
+// Check if two services are the same.
+func (s1 Service) Equal(s2 Service) bool {
+	if s1.Name != s2.Name ||
+		s1.Description != s2.Description ||
+		s1.Git != s2.Git ||
+		s1.Docker != s2.Docker ||
+		!s1.Candidate.Equal(s2.Candidate) ||
+		len(s1.Versions) != len(s2.Versions) {
+		return false
+	}
+	// Compare versions regardless of their order.
+	vs := map[string]Version{}
+	for _, v := range s1.Versions {
+		vs[v.Name] = v
+	}
+	for _, v := range s2.Versions {
+		v1, ok := vs[v.Name]
+		if !ok || !v1.Equal(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// A three-way merge of Manyfiles. Changes made on only one side, or made the
+// same way on both sides, are merged. Services and versions are merged
+// individually, so two sides adding different versions or changing different
+// services never conflict. If there are conflicts a *MergeConflictError is
+// returned, listing all of them.
+func Merge3(base Manyfile, ours Manyfile, theirs Manyfile) (Manyfile, error) {
+	var mg merger
+	m := Manyfile{
+		SchemaVersion: ours.SchemaVersion,
+		Name:          mg.str("name", base.Name, ours.Name, theirs.Name),
+		RemoteURL:     mg.str("remote_url", base.RemoteURL, ours.RemoteURL, theirs.RemoteURL),
+		RemoteName:    mg.str("remote_name", base.RemoteName, ours.RemoteName, theirs.RemoteName),
+		Versions:      mg.versions("versions", base.Versions, ours.Versions, theirs.Versions),
+		Services:      Services{},
+		CurrentRelease: mg.str(
+			"current_release",
+			base.CurrentRelease,
+			ours.CurrentRelease,
+			theirs.CurrentRelease,
+		),
+	}
+	// Keep the newest schema version, so a newer schema isn't downgraded.
+	if theirs.SchemaVersion > m.SchemaVersion {
+		m.SchemaVersion = theirs.SchemaVersion
+	}
+	// Merge each service.
+	ns := sortedKeys(func(add func(string)) {
+		for _, ss := range []Services{base.Services, ours.Services, theirs.Services} {
+			for n := range ss {
+				add(n)
+			}
+		}
+	})
+	for _, n := range ns {
+		p := "services." + n
+		b, inBase := base.Services[n]
+		o, inOurs := ours.Services[n]
+		t, inTheirs := theirs.Services[n]
+		switch {
+		// Present on both sides, merge the fields.
+		case inOurs && inTheirs:
+			m.Services[n] = mg.service(p, b, o, t)
+		// Added by us, or unchanged by us and deleted by them.
+		case inOurs && !inBase:
+			m.Services[n] = o
+		case inOurs && o.Equal(b):
+		// Added by them, or unchanged by them and deleted by us.
+		case inTheirs && !inBase:
+			m.Services[n] = t
+		case inTheirs && t.Equal(b):
+		// Deleted on one side and changed on the other.
+		case inOurs:
+			mg.conflict(p, "present", "changed", "")
+			m.Services[n] = o
+		case inTheirs:
+			mg.conflict(p, "present", "", "changed")
+		}
+		// Deleted on both sides is left out.
+	}
+	// Merge each environment.
+	ns = sortedKeys(func(add func(string)) {
+		for _, es := range []Environments{base.Environments, ours.Environments, theirs.Environments} {
+			for n := range es {
+				add(n)
+			}
+		}
+	})
+	for _, n := range ns {
+		p := "environments." + n
+		b, inBase := base.Environments[n]
+		o, inOurs := ours.Environments[n]
+		t, inTheirs := theirs.Environments[n]
+		var e Environment
+		switch {
+		case inOurs && inTheirs:
+			e = Environment{
+				Name:        mg.str(p+".name", b.Name, o.Name, t.Name),
+				Description: mg.str(p+".description", b.Description, o.Description, t.Description),
+				Deployments: mergeDeployments(o.Deployments, t.Deployments),
+			}
+		case inOurs && !inBase:
+			e = o
+		case inTheirs && !inBase:
+			e = t
+		// Deleted on one side, deployments on the other are kept.
+		case inOurs && len(o.Deployments) > len(b.Deployments):
+			mg.conflict(p, "present", "changed", "")
+			e = o
+		case inTheirs && len(t.Deployments) > len(b.Deployments):
+			mg.conflict(p, "present", "", "changed")
+			continue
+		default:
+			continue
+		}
+		if m.Environments == nil {
+			m.Environments = Environments{}
+		}
+		m.Environments[n] = e
+	}
+	if len(mg.conflicts) > 0 {
+		return m, &MergeConflictError{Conflicts: mg.conflicts}
+	}
+	return m, nil
+}
+
+// Collects conflicts during a three-way merge.
+type merger struct {
+	conflicts []MergeConflict
+}
+
+// Record a conflict.
+func (mg *merger) conflict(p string, base string, ours string, theirs string) {
+	mg.conflicts = append(
+		mg.conflicts,
+		MergeConflict{Path: p, Base: base, Ours: ours, Theirs: theirs},
+	)
+}
+
+// A three-way merge of services that are present on both sides. The base is
+// empty if the service was added on both sides.
+func (mg *merger) service(p string, base Service, ours Service, theirs Service) Service {
+	return Service{
+		Name:        mg.str(p+".name", base.Name, ours.Name, theirs.Name),
+		Description: mg.str(p+".description", base.Description, ours.Description, theirs.Description),
+		Git:         mg.str(p+".git", base.Git, ours.Git, theirs.Git),
+		Docker:      mg.str(p+".docker", base.Docker, ours.Docker, theirs.Docker),
+		Candidate:   mg.version(p+".candidate", base.Candidate, ours.Candidate, theirs.Candidate),
+		Versions:    mg.versions(p+".versions", base.Versions, ours.Versions, theirs.Versions),
+	}
+}
+
+// A three-way merge of a string.
+func (mg *merger) str(p string, base string, ours string, theirs string) string {
+	switch {
+	case ours == theirs, theirs == base:
+		return ours
+	case ours == base:
+		return theirs
+	}
+	mg.conflict(p, base, ours, theirs)
+	return ours
+}
+
+// A three-way merge of a version. The service versions of overall versions
+// are merged per service, the rest of the version is merged as a whole.
+func (mg *merger) version(p string, base Version, ours Version, theirs Version) Version {
+	switch {
+	case ours.Equal(theirs), theirs.Equal(base):
+		return ours
+	case ours.Equal(base):
+		return theirs
+	}
+	// Merge the version without its digest and services, which are merged
+	// separately since they are recorded after the version.
+	b, o, t := base, ours, theirs
+	b.Digest, o.Digest, t.Digest = "", "", ""
+	b.Services, o.Services, t.Services = nil, nil, nil
+	var v Version
+	switch {
+	case o.Equal(t), t.Equal(b):
+		v = o
+	case o.Equal(b):
+		v = t
+	default:
+		mg.conflict(
+			p,
+			describeVersion(base),
+			describeVersion(ours),
+			describeVersion(theirs),
+		)
+		return ours
+	}
+	v.Digest = mg.str(p+".digest", base.Digest, ours.Digest, theirs.Digest)
+	// Merge the services.
+	ns := sortedKeys(func(add func(string)) {
+		for _, sv := range []Version{base, ours, theirs} {
+			for n := range sv.Services {
+				add(n)
+			}
+		}
+	})
+	for _, n := range ns {
+		sv := mg.str(
+			p+".services."+n,
+			base.Services[n],
+			ours.Services[n],
+			theirs.Services[n],
+		)
+		// Empty means the service was removed.
+		if sv != "" {
+			if v.Services == nil {
+				v.Services = map[string]string{}
+			}
+			v.Services[n] = sv
+		}
+	}
+	return v
+}
+
+// Get the distinct keys added by a function, sorted. For example the names of
+// the services in several tables.
+func sortedKeys(keys func(add func(string))) []string {
+	m := map[string]bool{}
+	keys(func(k string) {
+		m[k] = true
+	})
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// A three-way merge of versions, matched by name.
+func (mg *merger) versions(p string, base Versions, ours Versions, theirs Versions) Versions {
+	bm, om, tm := versionsByName(base), versionsByName(ours), versionsByName(theirs)
+	// Names of all versions.
+	ns := sortedKeys(func(add func(string)) {
+		for _, vs := range []map[string]Version{bm, om, tm} {
+			for n := range vs {
+				add(n)
+			}
+		}
+	})
+	var vs Versions
+	for _, n := range ns {
+		b, inBase := bm[n]
+		o, inOurs := om[n]
+		t, inTheirs := tm[n]
+		switch {
+		// Present on both sides.
+		case inOurs && inTheirs:
+			vs = append(vs, mg.version(p+"."+n, b, o, t))
+		// Added by us, or unchanged by us and deleted by them.
+		case inOurs && !inBase:
+			vs = append(vs, o)
+		case inOurs && o.Equal(b):
+		// Added by them, or unchanged by them and deleted by us.
+		case inTheirs && !inBase:
+			vs = append(vs, t)
+		case inTheirs && t.Equal(b):
+		// Deleted on one side and changed on the other.
+		case inOurs:
+			mg.conflict(p+"."+n, describeVersion(b), describeVersion(o), "")
+			vs = append(vs, o)
+		case inTheirs:
+			mg.conflict(p+"."+n, describeVersion(b), "", describeVersion(t))
+		}
+	}
+	if vs == nil {
+		return Versions{}
+	}
+	sort.Sort(vs)
+	return vs
+}
+
+// Describe a version for the conflict report.
+func describeVersion(v Version) string {
+	if v.Equal(Version{}) {
+		return ""
+	}
+	d := v.Name
+	if v.Author != "" {
+		d += " by " + v.Author
+	}
+	if !v.Date.IsZero() {
+		d += " at " + v.Date.Format(time.RFC3339)
+	}
+	return d
+}
+
+// Index versions by name.
+func versionsByName(vs Versions) map[string]Version {
+	m := map[string]Version{}
+	for _, v := range vs {
+		m[v.Name] = v
+	}
+	return m
+}
+
+// Merge Manyfiles as a git merge driver. The merged Manyfile is written over
+// ours, in its format, which is left as it was if there are conflicts. The
+// formats are detected from the content since git gives the driver temporary
+// files.
+func MergeFiles(base string, ours string, theirs string) error {
+	var ms [3]Manyfile
+	var cs [3]Codec
+	for i, p := range []string{base, ours, theirs} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		cs[i], err = DetectCodec(b)
+		if err != nil {
+			return errorf(ErrInvalidManyfile, "%s: %s", p, err)
+		}
+		ms[i], err = DecodeManyfile(cs[i], b)
+		if err != nil {
+			return errorf(ErrInvalidManyfile, "%s: %s", p, err)
+		}
+	}
+	m, err := Merge3(ms[0], ms[1], ms[2])
+	if err != nil {
+		return err
+	}
+	// Write the merged Manyfile.
+	var b bytes.Buffer
+	err = EncodeManyfile(&b, cs[1], m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ours, b.Bytes())
+}
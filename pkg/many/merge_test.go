@@ -0,0 +1,220 @@
+package many
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A Manyfile with a service that has a version, for merging.
+func testMergeBase() Manyfile {
+	return Manyfile{
+		SchemaVersion: SchemaVersion,
+		Name:          "product",
+		Versions:      Versions{},
+		Services: Services{
+			"api": {
+				Name: "api",
+				Versions: Versions{
+					{Name: "1.0.0", Date: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+				},
+			},
+		},
+	}
+}
+
+// Copy a Manyfile so each side of a merge can be changed separately.
+func testCopy(t *testing.T, m Manyfile) Manyfile {
+	t.Helper()
+	ss := Services{}
+	for n, s := range m.Services {
+		s.Versions = append(Versions{}, s.Versions...)
+		ss[n] = s
+	}
+	c := m
+	c.Services = ss
+	c.Versions = append(Versions{}, m.Versions...)
+	return c
+}
+
+// Get the conflicts of a merge, failing the test if it isn't a conflict.
+func testConflicts(t *testing.T, err error) []MergeConflict {
+	t.Helper()
+	var ce *MergeConflictError
+	if !errors.As(err, &ce) || !errors.Is(err, ErrMergeConflict) {
+		t.Fatalf("got error %v, want a merge conflict", err)
+	}
+	return ce.Conflicts
+}
+
+func TestMerge3AddedVersions(t *testing.T) {
+	base := testMergeBase()
+	ours, theirs := testCopy(t, base), testCopy(t, base)
+	d := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	s := ours.Services["api"]
+	s.Versions.Add(Version{Name: "1.1.0", Date: d, Author: "ours"})
+	ours.Services["api"] = s
+	s = theirs.Services["api"]
+	s.Versions.Add(Version{Name: "1.2.0", Date: d, Author: "theirs"})
+	theirs.Services["api"] = s
+	m, err := Merge3(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range m.Services["api"].Versions {
+		names = append(names, v.Name)
+	}
+	if len(names) != 3 || names[0] != "1.0.0" || names[1] != "1.1.0" || names[2] != "1.2.0" {
+		t.Errorf("got versions %v, want 1.0.0, 1.1.0 and 1.2.0", names)
+	}
+}
+
+func TestMerge3SameVersionAddedDifferently(t *testing.T) {
+	base := testMergeBase()
+	ours, theirs := testCopy(t, base), testCopy(t, base)
+	s := ours.Services["api"]
+	s.Versions.Add(Version{Name: "1.1.0", Author: "ours"})
+	ours.Services["api"] = s
+	s = theirs.Services["api"]
+	s.Versions.Add(Version{Name: "1.1.0", Author: "theirs"})
+	theirs.Services["api"] = s
+	_, err := Merge3(base, ours, theirs)
+	cs := testConflicts(t, err)
+	if len(cs) != 1 || cs[0].Path != "services.api.versions.1.1.0" {
+		t.Errorf("got conflicts %+v", cs)
+	}
+}
+
+func TestMerge3DeletedAndChanged(t *testing.T) {
+	base := testMergeBase()
+	ours, theirs := testCopy(t, base), testCopy(t, base)
+	// We delete the service, they change it.
+	delete(ours.Services, "api")
+	s := theirs.Services["api"]
+	s.Description = "The API."
+	theirs.Services["api"] = s
+	_, err := Merge3(base, ours, theirs)
+	cs := testConflicts(t, err)
+	if len(cs) != 1 || cs[0].Path != "services.api" {
+		t.Errorf("got conflicts %+v", cs)
+	}
+	// Deleting a service the other side didn't change isn't a conflict.
+	theirs = testCopy(t, base)
+	m, err := Merge3(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Services["api"]; ok {
+		t.Error("deleted service api is present")
+	}
+}
+
+func TestMerge3Candidate(t *testing.T) {
+	base := testMergeBase()
+	ours, theirs := testCopy(t, base), testCopy(t, base)
+	s := ours.Services["api"]
+	s.Candidate = Version{Name: "abc"}
+	ours.Services["api"] = s
+	// The same candidate on both sides merges.
+	s = theirs.Services["api"]
+	s.Candidate = Version{Name: "abc"}
+	theirs.Services["api"] = s
+	m, err := Merge3(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := m.Services["api"].Candidate.Name; c != "abc" {
+		t.Errorf("got candidate %q, want abc", c)
+	}
+	// Different candidates conflict.
+	s.Candidate = Version{Name: "def"}
+	theirs.Services["api"] = s
+	_, err = Merge3(base, ours, theirs)
+	cs := testConflicts(t, err)
+	if len(cs) != 1 || cs[0].Path != "services.api.candidate" {
+		t.Errorf("got conflicts %+v", cs)
+	}
+}
+
+func TestMerge3ReleaseServices(t *testing.T) {
+	base := testMergeBase()
+	base.Versions = Versions{{
+		Name:     "v1.0.0",
+		Services: map[string]string{"api": "1.0.0", "web": "1.0.0"},
+	}}
+	ours, theirs := testCopy(t, base), testCopy(t, base)
+	ours.Versions[0].Services = map[string]string{"api": "1.1.0", "web": "1.0.0"}
+	theirs.Versions[0].Services = map[string]string{"api": "1.0.0", "web": "2.0.0", "db": "1.0.0"}
+	m, err := Merge3(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"api": "1.1.0", "web": "2.0.0", "db": "1.0.0"}
+	got := m.Versions[0].Services
+	if len(got) != len(want) {
+		t.Fatalf("got services %v, want %v", got, want)
+	}
+	for n, v := range want {
+		if got[n] != v {
+			t.Errorf("got %s %s, want %s", n, got[n], v)
+		}
+	}
+	// Changing the same service differently conflicts.
+	theirs.Versions[0].Services["api"] = "1.2.0"
+	_, err = Merge3(base, ours, theirs)
+	cs := testConflicts(t, err)
+	if len(cs) != 1 || cs[0].Path != "versions.v1.0.0.services.api" {
+		t.Errorf("got conflicts %+v", cs)
+	}
+}
+
+func TestMergeFilesEmptyBase(t *testing.T) {
+	// git gives an empty base file when both sides add the Manyfile.
+	dir := testTempDir(t)
+	base := filepath.Join(dir, "base")
+	ours := filepath.Join(dir, "ours")
+	theirs := filepath.Join(dir, "theirs")
+	err := ioutil.WriteFile(base, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(ours, []byte(`schema_version: 5
+name: product
+services:
+  api:
+    name: api
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(theirs, []byte(`schema_version = 5
+name = "product"
+[services.web]
+  name = "web"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = MergeFiles(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The result is written over ours, in its format.
+	b, err := ioutil.ReadFile(ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := DecodeManyfile(YAMLCodec{}, b)
+	if err != nil {
+		t.Fatalf("merged file isn't YAML: %s", err)
+	}
+	if _, ok := m.Services["api"]; !ok {
+		t.Error("our service api is missing")
+	}
+	if _, ok := m.Services["web"]; !ok {
+		t.Error("their service web is missing")
+	}
+}
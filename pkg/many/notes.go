@@ -0,0 +1,168 @@
+package many
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// The template used for release notes when none is given. Markdown.
+const DefaultNotesTemplate = `# {{.Release.Name}}
+{{with .Release.Description}}
+{{.}}
+{{end}}
+{{- if not .Release.Date.IsZero}}
+Released {{date .Release.Date}}{{with .Release.Author}} by {{.}}{{end}}.
+{{end}}
+| Service | Version | Change | Date | Author | Description |
+|---------|---------|--------|------|--------|-------------|
+{{- range .Services}}
+| {{.Name}} | {{.Version.Name}} | {{if eq .Change "changed"}}{{.Previous}} → {{.Version.Name}}{{else}}{{.Change}}{{end}} | {{date .Version.Date}} | {{.Version.Author}} | {{.Version.Description}} |
+{{- end}}
+{{- with .Diff}}
+{{- with .Filter "removed"}}
+
+Removed services:
+{{range .}}
+- {{.Service}} {{.From}}
+{{- end}}
+{{- end}}
+{{- end}}
+`
+
+// The release notes template used if it exists in a repo and none is given.
+const NotesTemplateFile = "notes.tmpl"
+
+// A service in release notes.
+type NotesService struct {
+	Name        string
+	Description string
+	// The service's version in the release. Only the name is set if the
+	// version isn't one of the service's recorded versions.
+	Version VersionView
+	// How the service changed since the previous release, and its version
+	// there. Added if there is no previous release.
+	Change   Change
+	Previous string
+}
+
+// The data given to release notes templates.
+type Notes struct {
+	Release VersionView
+	// The release before this one. Nil for the first release.
+	Previous *VersionView
+	// The services in the release, by name.
+	Services []NotesService
+	// The differences from the previous release. Nil for the first release.
+	Diff *ReleaseDiff
+}
+
+// Functions available to release notes templates.
+var notesFuncs = template.FuncMap{
+	// Format a date as YYYY-MM-DD, empty if it isn't set.
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02")
+	},
+}
+
+// Get the release before an overall version: the highest semantic version
+// below it that records its services.
+func (m Manyfile) previousRelease(v Version) (Version, bool) {
+	var p Version
+	found := false
+	for _, o := range m.Versions {
+		if _, err := ParseSemver(o.Name); err != nil || len(o.Services) == 0 {
+			continue
+		}
+		if CompareVersions(o, v) < 0 && (!found || CompareVersions(p, o) < 0) {
+			p, found = o, true
+		}
+	}
+	return p, found
+}
+
+// Gather the data for the release notes of an overall version.
+func (m Manyfile) Notes(version string) (Notes, error) {
+	v, err := m.FindRelease(version)
+	if err != nil {
+		return Notes{}, err
+	}
+	n := Notes{Release: NewVersionView(v)}
+	// The differences from the previous release.
+	changes := map[string]ServiceDiff{}
+	if p, ok := m.previousRelease(v); ok && len(v.Services) > 0 {
+		pv := NewVersionView(p)
+		n.Previous = &pv
+		d, err := m.DiffReleases(p.Name, v.Name)
+		if err != nil {
+			return Notes{}, err
+		}
+		n.Diff = &d
+		for _, sd := range d.Services {
+			changes[sd.Service] = sd
+		}
+	}
+	// The services in the release.
+	names := sortedKeys(func(add func(string)) {
+		for s := range v.Services {
+			add(s)
+		}
+	})
+	for _, s := range names {
+		ns := NotesService{
+			Name:    s,
+			Version: VersionView{Name: v.Services[s]},
+			Change:  ChangeAdded,
+		}
+		if sv, ok := m.Services[s]; ok {
+			ns.Description = sv.Description
+			if e, ok := sv.Versions.Find(v.Services[s]); ok {
+				ns.Version = NewVersionView(e)
+			}
+		}
+		if sd, ok := changes[s]; ok {
+			ns.Change = sd.Change
+			ns.Previous = sd.From
+		}
+		n.Services = append(n.Services, ns)
+	}
+	return n, nil
+}
+
+// Read a release notes template from a file in the repo. Without a file,
+// NotesTemplateFile is read if it exists, otherwise DefaultNotesTemplate is
+// returned.
+func (r *Repo) NotesTemplate(file string) (string, error) {
+	p := file
+	if p == "" {
+		p = NotesTemplateFile
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(r.Path, p)
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) && file == "" {
+		return DefaultNotesTemplate, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Render release notes with a text/template. See Notes for the data and
+// DefaultNotesTemplate for an example. Templates can use the date function
+// to format dates.
+func RenderNotes(w io.Writer, tmpl string, n Notes) error {
+	t, err := template.New("notes").Funcs(notesFuncs).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, n)
+}
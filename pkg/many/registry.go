@@ -0,0 +1,591 @@
+package many
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// Docker tags.
+	dockerTagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	// Parameters of WWW-Authenticate challenges, for example
+	// `realm="https://auth.docker.io/token"`.
+	challengeParamRegexp = regexp.MustCompile(`([A-Za-z]+)="([^"]*)"`)
+	// The manifest types accepted from registries. Lists and indexes are
+	// included so multi-platform images resolve to the digest of the list.
+	manifestTypes = []string{
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.oci.image.index.v1+json",
+	}
+)
+
+// The registry of images without a registry host.
+const dockerHubHost = "registry-1.docker.io"
+
+// A client for Docker registries, speaking the Docker Registry HTTP API v2
+// which OCI registries share.
+type Registry struct {
+	// Defaults to a client with a timeout.
+	Client *http.Client
+	// Credentials for registries that require them. Used for basic auth, or
+	// to get bearer tokens from the registry's token service.
+	Username string
+	Password string
+	// Hosts of registries reached over plain HTTP, with their ports.
+	// Registries on localhost always are.
+	Insecure []string
+}
+
+// Split a Docker repository into its registry host and its path in the
+// registry.
+func splitImage(image string) (string, string) {
+	i := strings.Index(image, "/")
+	// The first part is a host if it looks like one.
+	if i >= 0 {
+		h := image[:i]
+		if strings.ContainsAny(h, ".:") || h == "localhost" {
+			return h, image[i+1:]
+		}
+	}
+	// Official images on Docker Hub are in the library namespace.
+	if i < 0 {
+		return dockerHubHost, "library/" + image
+	}
+	return dockerHubHost, image
+}
+
+// Get a registry's base URL.
+func (r *Registry) baseURL(host string) string {
+	scheme := "https"
+	h := host
+	if i := strings.LastIndex(h, ":"); i > strings.LastIndex(h, "]") {
+		h = h[:i]
+	}
+	if h == "localhost" || h == "127.0.0.1" || h == "[::1]" {
+		scheme = "http"
+	}
+	for _, i := range r.Insecure {
+		if i == host {
+			scheme = "http"
+		}
+	}
+	return scheme + "://" + host
+}
+
+// Send a request for a repository, authenticating and retrying if the
+// registry asks for it. Pushes ask for push access.
+func (r *Registry) do(
+	method string,
+	u string,
+	repo string,
+	body []byte,
+	header http.Header,
+) (*http.Response, error) {
+	c := r.Client
+	if c == nil {
+		c = &http.Client{Timeout: 30 * time.Second}
+	}
+	// The request is sent again after authenticating, so it needs a fresh
+	// body each time.
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+		return req, nil
+	}
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, errorf(ErrRegistry, "Registry request failed: %s.", err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+	res.Body.Close()
+	// Answer the challenge.
+	challenge := res.Header.Get("WWW-Authenticate")
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	switch scheme {
+	case "basic":
+		if r.Username == "" {
+			return nil, errorf(
+				ErrRegistryAuth,
+				"Registry %s requires credentials.",
+				req.URL.Host,
+			)
+		}
+		req.SetBasicAuth(r.Username, r.Password)
+	case "bearer":
+		actions := "pull"
+		if method == http.MethodPut {
+			actions = "pull,push"
+		}
+		t, err := r.token(c, challenge, "repository:"+repo+":"+actions)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+t)
+	default:
+		return nil, errorf(
+			ErrRegistryAuth,
+			"Registry %s asks for unsupported authentication %q.",
+			req.URL.Host,
+			challenge,
+		)
+	}
+	res, err = c.Do(req)
+	if err != nil {
+		return nil, errorf(ErrRegistry, "Registry request failed: %s.", err)
+	}
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		res.Body.Close()
+		return nil, errorf(
+			ErrRegistryAuth,
+			"Registry %s refused the credentials.",
+			req.URL.Host,
+		)
+	}
+	return res, nil
+}
+
+// Get a bearer token from the token service named by a challenge, for a
+// scope unless the challenge names one.
+func (r *Registry) token(c *http.Client, challenge string, scope string) (string, error) {
+	ps := map[string]string{}
+	for _, m := range challengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		ps[strings.ToLower(m[1])] = m[2]
+	}
+	if ps["realm"] == "" {
+		return "", errorf(ErrRegistryAuth, "Registry challenge %q has no realm.", challenge)
+	}
+	if ps["scope"] == "" {
+		ps["scope"] = scope
+	}
+	q := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if ps[k] != "" {
+			q.Set(k, ps[k])
+		}
+	}
+	u := ps["realm"]
+	if strings.Contains(u, "?") {
+		u += "&" + q.Encode()
+	} else {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return "", errorf(ErrRegistry, "Token request failed: %s.", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errorf(
+			ErrRegistryAuth,
+			"Token service %s responded %s.",
+			req.URL.Host,
+			res.Status,
+		)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&t)
+	if err != nil {
+		return "", errorf(ErrRegistryAuth, "Invalid token response: %s.", err)
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	return t.Token, nil
+}
+
+// Get the digest of a tagged image, for example "sha256:4f5...". Missing
+// images are ErrImageNotFound.
+func (r *Registry) Digest(image string, tag string) (string, error) {
+	if !dockerTagRegexp.MatchString(tag) {
+		return "", errorf(ErrInvalidVersion, "%s is not a valid Docker tag.", tag)
+	}
+	host, repo := splitImage(image)
+	u := r.baseURL(host) + "/v2/" + repo + "/manifests/" + tag
+	// Ask for the headers only, registries give the digest in them.
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		res, err := r.do(method, u, repo, nil, nil)
+		if err != nil {
+			return "", err
+		}
+		d, err := manifestDigest(res)
+		res.Body.Close()
+		if err != nil {
+			return "", errorf(ErrRegistry, "%s:%s: %s", image, tag, err)
+		}
+		switch {
+		case res.StatusCode == http.StatusNotFound:
+			return "", errorf(ErrImageNotFound, "Image %s:%s doesn't exist.", image, tag)
+		case res.StatusCode != http.StatusOK:
+			return "", errorf(
+				ErrRegistry,
+				"Registry %s responded %s for %s:%s.",
+				host,
+				res.Status,
+				image,
+				tag,
+			)
+		case d != "":
+			return d, nil
+		}
+	}
+	return "", errorf(ErrRegistry, "Registry %s gave no digest for %s:%s.", host, image, tag)
+}
+
+// Get a tagged image's manifest, its media type and its digest.
+func (r *Registry) manifest(image string, tag string) ([]byte, string, string, error) {
+	host, repo := splitImage(image)
+	u := r.baseURL(host) + "/v2/" + repo + "/manifests/" + tag
+	res, err := r.do(http.MethodGet, u, repo, nil, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", "", errorf(ErrImageNotFound, "Image %s:%s doesn't exist.", image, tag)
+	default:
+		return nil, "", "", errorf(
+			ErrRegistry,
+			"Registry %s responded %s for %s:%s.",
+			host,
+			res.Status,
+			image,
+			tag,
+		)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", "", errorf(ErrRegistry, "%s:%s: %s", image, tag, err)
+	}
+	t := strings.TrimSpace(strings.Split(res.Header.Get("Content-Type"), ";")[0])
+	d := res.Header.Get("Docker-Content-Digest")
+	if d == "" {
+		d = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	}
+	return data, t, d, nil
+}
+
+// Tag a tagged image with another tag in the same repository, by copying
+// its manifest. Returns the image's digest and whether the tag was created or
+// moved. Nothing is pushed if the tag already points at the image. A tag
+// that points at another image is ErrTagExists unless force is set.
+func (r *Registry) Tag(image string, tag string, newTag string, force bool) (string, bool, error) {
+	if !dockerTagRegexp.MatchString(newTag) {
+		return "", false, errorf(ErrInvalidVersion, "%s is not a valid Docker tag.", newTag)
+	}
+	data, t, d, err := r.manifest(image, tag)
+	if err != nil {
+		return "", false, err
+	}
+	// Check the new tag.
+	e, err := r.Digest(image, newTag)
+	switch {
+	case err == nil && e == d:
+		return d, false, nil
+	case err == nil && !force:
+		return d, false, errorf(
+			ErrTagExists,
+			"Image %s:%s already exists with another digest. Use --force to move it.",
+			image,
+			newTag,
+		)
+	case err != nil && !errors.Is(err, ErrImageNotFound):
+		return "", false, err
+	}
+	// Push the manifest with the new tag.
+	host, repo := splitImage(image)
+	u := r.baseURL(host) + "/v2/" + repo + "/manifests/" + newTag
+	res, err := r.do(http.MethodPut, u, repo, data, http.Header{"Content-Type": {t}})
+	if err != nil {
+		return "", false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return "", false, errorf(
+			ErrRegistry,
+			"Registry %s responded %s when tagging %s:%s: %s",
+			host,
+			res.Status,
+			image,
+			newTag,
+			strings.TrimSpace(string(msg)),
+		)
+	}
+	return d, true, nil
+}
+
+// Get the digest of a manifest response, from the header or by hashing the
+// manifest.
+func manifestDigest(res *http.Response) (string, error) {
+	if res.StatusCode != http.StatusOK {
+		return "", nil
+	}
+	if d := res.Header.Get("Docker-Content-Digest"); d != "" {
+		return d, nil
+	}
+	if res.Request.Method == http.MethodHead {
+		return "", nil
+	}
+	h := sha256.New()
+	_, err := io.Copy(h, res.Body)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// The outcome of checking a service's image.
+type ImageStatus string
+
+const (
+	// The image exists. Its digest is recorded if it wasn't already.
+	ImageFound ImageStatus = "found"
+	// The image doesn't exist.
+	ImageMissing ImageStatus = "missing"
+	// The image exists with a different digest to the recorded one.
+	ImageChanged ImageStatus = "changed"
+	// The service has no image or no version to check.
+	ImageSkipped ImageStatus = "skipped"
+	// The version isn't a valid Docker tag, for example a semantic version
+	// with build metadata, so it can't have an image.
+	ImageInvalid ImageStatus = "invalid"
+)
+
+// A check of a service's image.
+type ImageCheck struct {
+	Service string      `json:"service" yaml:"service"`
+	Version string      `json:"version,omitempty" yaml:"version,omitempty"`
+	Image   string      `json:"image,omitempty" yaml:"image,omitempty"`
+	Digest  string      `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Status  ImageStatus `json:"status" yaml:"status"`
+}
+
+// Check that the Docker images of services exist in their registries, for
+// the latest version of each service or for their candidates. Services
+// without a Docker repository are skipped. The digests of found images are
+// recorded in the versions, or checked against those already recorded.
+// Versions that aren't valid Docker tags are reported as invalid. An error is
+// returned with the checks if any image is missing or changed. No names means
+// all services.
+func (m *Manyfile) VerifyImages(
+	reg *Registry,
+	names []string,
+	candidates bool,
+) ([]ImageCheck, error) {
+	if len(names) == 0 {
+		names = sortedKeys(func(add func(string)) {
+			for n := range m.Services {
+				add(n)
+			}
+		})
+	}
+	var checks []ImageCheck
+	var missing, changed []string
+	for _, n := range names {
+		s, err := m.Service(n)
+		if err != nil {
+			return nil, err
+		}
+		// The version to check.
+		v, ok := s.Versions.Latest()
+		if candidates {
+			v, ok = s.Candidate, s.Candidate.Name != ""
+		}
+		c := ImageCheck{Service: n, Version: v.Name, Status: ImageSkipped}
+		if !ok || s.Docker == "" {
+			checks = append(checks, c)
+			continue
+		}
+		c.Image = s.Docker + ":" + v.Name
+		c.Digest, err = reg.Digest(s.Docker, v.Name)
+		switch {
+		case errors.Is(err, ErrImageNotFound):
+			c.Status = ImageMissing
+			missing = append(missing, c.Image)
+		case errors.Is(err, ErrInvalidVersion):
+			c.Status = ImageInvalid
+			c.Image = ""
+		case err != nil:
+			return nil, err
+		case v.Digest != "" && v.Digest != c.Digest:
+			c.Status = ImageChanged
+			changed = append(changed, c.Image)
+		default:
+			c.Status = ImageFound
+			v.Digest = c.Digest
+			if candidates {
+				s.Candidate = v
+			} else {
+				s.Versions.Add(v)
+			}
+			m.Services[n] = s
+		}
+		checks = append(checks, c)
+	}
+	switch {
+	case len(missing) > 0:
+		return checks, errorf(
+			ErrImageNotFound,
+			"Images don't exist: %s.",
+			strings.Join(missing, ", "),
+		)
+	case len(changed) > 0:
+		return checks, errorf(
+			ErrDigestMismatch,
+			"Images have changed since they were verified: %s.",
+			strings.Join(changed, ", "),
+		)
+	}
+	return checks, nil
+}
+
+// The outcome of tagging a service's image, or its commit.
+type TagStatus string
+
+const (
+	// The tag was created or moved to the image.
+	TagCreated TagStatus = "tagged"
+	// The tag already pointed at the image.
+	TagUnchanged TagStatus = "unchanged"
+	// The service has no image, or no git repository.
+	TagSkipped TagStatus = "skipped"
+	// The image couldn't be tagged, see the error.
+	TagFailed TagStatus = "failed"
+	// The tag would be created, but this is a dry run.
+	TagPlanned TagStatus = "planned"
+)
+
+// The result of tagging a service's image.
+type TagResult struct {
+	Service string    `json:"service" yaml:"service"`
+	Version string    `json:"version" yaml:"version"`
+	Image   string    `json:"image,omitempty" yaml:"image,omitempty"`
+	Tag     string    `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Digest  string    `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Status  TagStatus `json:"status" yaml:"status"`
+	Error   string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Tag the Docker image of each service's version in an overall version with
+// the overall version's name, so the release can be pulled by the product
+// version. Services without a Docker repository are skipped. A service
+// version's image must still have the digest recorded by verify, if any.
+// Every service is tried; an error is returned with the results if any
+// failed.
+func (m Manyfile) TagImages(reg *Registry, release string, force bool) ([]TagResult, error) {
+	v, err := m.FindRelease(release)
+	if err != nil {
+		return nil, err
+	}
+	if len(v.Services) == 0 {
+		return nil, errorf(
+			ErrNoServices,
+			"Version %s doesn't record the versions of its services.",
+			release,
+		)
+	}
+	var rs []TagResult
+	var failed []string
+	var first error
+	ns := sortedKeys(func(add func(string)) {
+		for n := range v.Services {
+			add(n)
+		}
+	})
+	for _, n := range ns {
+		r := TagResult{Service: n, Version: v.Services[n], Status: TagSkipped}
+		s, ok := m.Services[n]
+		if !ok || s.Docker == "" {
+			rs = append(rs, r)
+			continue
+		}
+		r.Image = s.Docker + ":" + r.Version
+		r.Tag = s.Docker + ":" + release
+		// Tag the image, checking it is the one that was verified.
+		err := func() error {
+			if sv, ok := s.Versions.Find(r.Version); ok && sv.Digest != "" {
+				d, err := reg.Digest(s.Docker, r.Version)
+				if err != nil {
+					return err
+				}
+				if d != sv.Digest {
+					return errorf(
+						ErrDigestMismatch,
+						"Image %s has changed since it was verified.",
+						r.Image,
+					)
+				}
+			}
+			d, created, err := reg.Tag(s.Docker, r.Version, release, force)
+			r.Digest = d
+			r.Status = TagUnchanged
+			if created {
+				r.Status = TagCreated
+			}
+			return err
+		}()
+		if err != nil {
+			r.Status = TagFailed
+			r.Error = err.Error()
+			failed = append(failed, n)
+			if first == nil {
+				first = err
+			}
+		}
+		rs = append(rs, r)
+	}
+	if len(failed) > 0 {
+		// The error is of the kind of the first failure.
+		k := ErrRegistry
+		var e *Error
+		if errors.As(first, &e) {
+			k = e.Kind
+		}
+		return rs, errorf(
+			k,
+			"Images of services couldn't be tagged: %s.",
+			strings.Join(failed, ", "),
+		)
+	}
+	return rs, nil
+}
@@ -0,0 +1,352 @@
+package many
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake Docker registry holding manifests by repository and tag.
+type testRegistry struct {
+	sync.Mutex
+	// Manifests by "repo:tag".
+	manifests map[string]string
+	// "basic" or "bearer" to require credentials, bob and secret.
+	auth string
+	// Leave out the digest header, so clients hash the manifest.
+	noDigest bool
+	// The requests, as "METHOD path".
+	requests []string
+	server   *httptest.Server
+}
+
+// Start a fake registry with manifests by "repo:tag". Close it when done.
+func newTestRegistry(auth string, manifests map[string]string) *testRegistry {
+	tr := &testRegistry{manifests: manifests, auth: auth}
+	tr.server = httptest.NewServer(tr)
+	return tr
+}
+
+// The host of the registry, for image names.
+func (tr *testRegistry) host() string {
+	return strings.TrimPrefix(tr.server.URL, "http://")
+}
+
+// The digest of a manifest.
+func testDigest(manifest string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+}
+
+func (tr *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr.Lock()
+	defer tr.Unlock()
+	// The token service.
+	if r.URL.Path == "/token" {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != "bob" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": "t0k3n"}`)
+		return
+	}
+	tr.requests = append(tr.requests, r.Method+" "+r.URL.Path)
+	// Challenge requests without credentials.
+	switch tr.auth {
+	case "basic":
+		u, p, ok := r.BasicAuth()
+		if !ok || u != "bob" || p != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	case "bearer":
+		if r.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.Header().Set(
+				"WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="test"`, tr.server.URL),
+			)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	// Paths are /v2/<repo>/manifests/<tag>.
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	i := strings.LastIndex(p, "/manifests/")
+	if i < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	k := p[:i] + ":" + p[i+len("/manifests/"):]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		m, ok := tr.manifests[k]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		if !tr.noDigest {
+			w.Header().Set("Docker-Content-Digest", testDigest(m))
+		}
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, m)
+		}
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tr.manifests[k] = string(b)
+		w.Header().Set("Docker-Content-Digest", testDigest(string(b)))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRegistryDigest(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     string
+		noDigest bool
+		requests []string
+	}{
+		{"HEAD", "", false, []string{"HEAD /v2/team/api/manifests/1.0.0"}},
+		{"GET", "", true, []string{
+			"HEAD /v2/team/api/manifests/1.0.0",
+			"GET /v2/team/api/manifests/1.0.0",
+		}},
+		{"basic", "basic", false, []string{
+			"HEAD /v2/team/api/manifests/1.0.0",
+			"HEAD /v2/team/api/manifests/1.0.0",
+		}},
+		{"bearer", "bearer", false, []string{
+			"HEAD /v2/team/api/manifests/1.0.0",
+			"HEAD /v2/team/api/manifests/1.0.0",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := newTestRegistry(test.auth, map[string]string{"team/api:1.0.0": "manifest"})
+			defer tr.server.Close()
+			tr.noDigest = test.noDigest
+			reg := &Registry{Username: "bob", Password: "secret"}
+			d, err := reg.Digest(tr.host()+"/team/api", "1.0.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d != testDigest("manifest") {
+				t.Errorf("got digest %s, want %s", d, testDigest("manifest"))
+			}
+			if strings.Join(tr.requests, ", ") != strings.Join(test.requests, ", ") {
+				t.Errorf("got requests %v, want %v", tr.requests, test.requests)
+			}
+		})
+	}
+}
+
+func TestRegistryDigestErrors(t *testing.T) {
+	tr := newTestRegistry("", map[string]string{})
+	defer tr.server.Close()
+	reg := &Registry{}
+	_, err := reg.Digest(tr.host()+"/team/api", "1.0.0")
+	if !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("got error %v, want ErrImageNotFound", err)
+	}
+	// Build metadata isn't allowed in Docker tags.
+	_, err = reg.Digest(tr.host()+"/team/api", "1.0.0+b.5")
+	if !errors.Is(err, ErrInvalidVersion) {
+		t.Errorf("got error %v, want ErrInvalidVersion", err)
+	}
+	if len(tr.requests) != 1 {
+		t.Errorf("got requests %v, want one", tr.requests)
+	}
+	// Credentials are required, and must be right.
+	for _, auth := range []string{"basic", "bearer"} {
+		tr = newTestRegistry(auth, map[string]string{"team/api:1.0.0": "manifest"})
+		defer tr.server.Close()
+		_, err = reg.Digest(tr.host()+"/team/api", "1.0.0")
+		if !errors.Is(err, ErrRegistryAuth) {
+			t.Errorf("%s: got error %v without credentials, want ErrRegistryAuth", auth, err)
+		}
+		bad := &Registry{Username: "bob", Password: "wrong"}
+		_, err = bad.Digest(tr.host()+"/team/api", "1.0.0")
+		if !errors.Is(err, ErrRegistryAuth) {
+			t.Errorf("%s: got error %v with wrong credentials, want ErrRegistryAuth", auth, err)
+		}
+	}
+}
+
+func TestVerifyImages(t *testing.T) {
+	tr := newTestRegistry("", map[string]string{
+		"team/api:1.0.0": "api",
+		"team/web:2.0.0": "web",
+	})
+	defer tr.server.Close()
+	d := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := Manyfile{Services: Services{
+		"api": {Name: "api", Docker: tr.host() + "/team/api", Versions: Versions{
+			{Name: "1.0.0", Date: d},
+		}},
+		// A build metadata version can't be a tag, so it can't be checked.
+		"build": {Name: "build", Docker: tr.host() + "/team/build", Versions: Versions{
+			{Name: "1.0.0+b.5", Date: d},
+		}},
+		"db": {Name: "db", Versions: Versions{{Name: "1.0.0", Date: d}}},
+		"web": {Name: "web", Docker: tr.host() + "/team/web", Versions: Versions{
+			{Name: "2.0.0", Date: d},
+		}},
+	}}
+	cs, err := m.VerifyImages(&Registry{}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ImageStatus{
+		"api":   ImageFound,
+		"build": ImageInvalid,
+		"db":    ImageSkipped,
+		"web":   ImageFound,
+	}
+	if len(cs) != len(want) {
+		t.Fatalf("got checks %+v", cs)
+	}
+	for _, c := range cs {
+		if c.Status != want[c.Service] {
+			t.Errorf("%s: got status %s, want %s", c.Service, c.Status, want[c.Service])
+		}
+	}
+	// Digests are recorded.
+	if v, _ := m.Services["api"].Versions.Find("1.0.0"); v.Digest != testDigest("api") {
+		t.Errorf("got digest %q recorded for api", v.Digest)
+	}
+	// Changed and missing images are errors.
+	tr.manifests["team/api:1.0.0"] = "rebuilt"
+	delete(tr.manifests, "team/web:2.0.0")
+	cs, err = m.VerifyImages(&Registry{}, []string{"api"}, false)
+	if !errors.Is(err, ErrDigestMismatch) || cs[0].Status != ImageChanged {
+		t.Errorf("got error %v and checks %+v, want api changed", err, cs)
+	}
+	cs, err = m.VerifyImages(&Registry{}, []string{"web"}, false)
+	if !errors.Is(err, ErrImageNotFound) || cs[0].Status != ImageMissing {
+		t.Errorf("got error %v and checks %+v, want web missing", err, cs)
+	}
+}
+
+func TestRegistryTag(t *testing.T) {
+	tr := newTestRegistry("bearer", map[string]string{
+		"team/api:1.0.0": "api 1",
+		"team/api:1.1.0": "api 2",
+	})
+	defer tr.server.Close()
+	reg := &Registry{Username: "bob", Password: "secret"}
+	image := tr.host() + "/team/api"
+	// Create the tag.
+	d, created, err := reg.Tag(image, "1.0.0", "v1.0.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || d != testDigest("api 1") || tr.manifests["team/api:v1.0.0"] != "api 1" {
+		t.Errorf("got digest %s and created %t, want the tag created", d, created)
+	}
+	// Tagging again changes nothing.
+	n := len(tr.requests)
+	d, created, err = reg.Tag(image, "1.0.0", "v1.0.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || d != testDigest("api 1") {
+		t.Errorf("got digest %s and created %t, want the tag unchanged", d, created)
+	}
+	for _, r := range tr.requests[n:] {
+		if strings.HasPrefix(r, "PUT ") {
+			t.Errorf("tagging again sent %s", r)
+		}
+	}
+	// A tag on another image isn't moved without force.
+	_, _, err = reg.Tag(image, "1.1.0", "v1.0.0", false)
+	if !errors.Is(err, ErrTagExists) {
+		t.Fatalf("got error %v, want ErrTagExists", err)
+	}
+	if tr.manifests["team/api:v1.0.0"] != "api 1" {
+		t.Error("tag was moved without force")
+	}
+	_, created, err = reg.Tag(image, "1.1.0", "v1.0.0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || tr.manifests["team/api:v1.0.0"] != "api 2" {
+		t.Error("tag wasn't moved with force")
+	}
+	// The image must exist.
+	_, _, err = reg.Tag(image, "9.9.9", "v9.9.9", false)
+	if !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("got error %v, want ErrImageNotFound", err)
+	}
+}
+
+func TestTagImages(t *testing.T) {
+	tr := newTestRegistry("", map[string]string{
+		"team/api:1.0.0": "api",
+		"team/web:2.0.0": "web",
+	})
+	defer tr.server.Close()
+	m := Manyfile{
+		Services: Services{
+			"api": {Name: "api", Docker: tr.host() + "/team/api", Versions: Versions{
+				{Name: "1.0.0", Digest: testDigest("api")},
+			}},
+			"db":  {Name: "db"},
+			"web": {Name: "web", Docker: tr.host() + "/team/web", Versions: Versions{{Name: "2.0.0"}}},
+		},
+		Versions: Versions{{
+			Name:     "v1.0.0",
+			Services: map[string]string{"api": "1.0.0", "db": "3.0.0", "web": "2.0.0"},
+		}},
+	}
+	rs, err := m.TagImages(&Registry{}, "v1.0.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]TagStatus{"api": TagCreated, "db": TagSkipped, "web": TagCreated}
+	for _, r := range rs {
+		if r.Status != want[r.Service] {
+			t.Errorf("%s: got status %s, want %s", r.Service, r.Status, want[r.Service])
+		}
+	}
+	// Running again changes nothing.
+	rs, err = m.TagImages(&Registry{}, "v1.0.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rs {
+		if r.Service != "db" && r.Status != TagUnchanged {
+			t.Errorf("%s: got status %s, want unchanged", r.Service, r.Status)
+		}
+	}
+	// An image that changed since it was verified isn't tagged, but the
+	// other services are.
+	tr.manifests["team/api:1.0.0"] = "rebuilt"
+	delete(tr.manifests, "team/web:v1.0.0")
+	rs, err = m.TagImages(&Registry{}, "v1.0.0", true)
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("got error %v, want ErrDigestMismatch", err)
+	}
+	want = map[string]TagStatus{"api": TagFailed, "db": TagSkipped, "web": TagCreated}
+	for _, r := range rs {
+		if r.Status != want[r.Service] {
+			t.Errorf("%s: got status %s, want %s", r.Service, r.Status, want[r.Service])
+		}
+	}
+	if tr.manifests["team/api:v1.0.0"] != "api" {
+		t.Error("changed image was tagged")
+	}
+}
@@ -0,0 +1,126 @@
+package many
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Get the latest version, the last in version order. See CompareVersions.
+func (vs Versions) Latest() (Version, bool) {
+	if len(vs) == 0 {
+		return Version{}, false
+	}
+	l := vs[0]
+	for _, v := range vs[1:] {
+		if CompareVersions(l, v) < 0 {
+			l = v
+		}
+	}
+	return l, true
+}
+
+// Get the overall version with the highest semantic version. Versions that
+// are not semantic versions are ignored.
+func (vs Versions) LatestRelease() (Version, Semver, bool) {
+	var l Version
+	var ls Semver
+	found := false
+	for _, v := range vs {
+		s, err := ParseSemver(v.Name)
+		if err != nil {
+			continue
+		}
+		if !found || CompareVersions(l, v) < 0 {
+			l, ls, found = v, s, true
+		}
+	}
+	return l, ls, found
+}
+
+// Get an overall version by name.
+func (m Manyfile) FindRelease(name string) (Version, error) {
+	v, ok := m.Versions.Find(name)
+	if !ok {
+		return Version{}, errorf(ErrVersionNotFound, "Unknown version %s.", name)
+	}
+	return v, nil
+}
+
+// Get the current overall version, the one rolled back to if the product was
+// rolled back, otherwise the one with the highest semantic version.
+func (m Manyfile) Current() (Version, error) {
+	if m.CurrentRelease != "" {
+		return m.FindRelease(m.CurrentRelease)
+	}
+	v, _, ok := m.Versions.LatestRelease()
+	if !ok {
+		return Version{}, errorf(
+			ErrNoReleases,
+			"There are no releases. Use release to create one.",
+		)
+	}
+	return v, nil
+}
+
+// Create a new overall version containing the latest version of every
+// service. The version is the latest overall version incremented by the
+// release category, named with a "v" prefix if the latest is or if there is
+// none. Every service must have a version. An incompatible
+// release can't be rolled back past. A release makes the new version current
+// again after a rollback.
+func (m *Manyfile) Release(
+	category string,
+	description string,
+	author string,
+	date time.Time,
+	incompatible bool,
+) (Version, error) {
+	// Work out the new version.
+	lv, l, found := m.Versions.LatestRelease()
+	n, err := l.Bump(category)
+	if err != nil {
+		return Version{}, err
+	}
+	name := n.String()
+	if found && !strings.HasPrefix(lv.Name, "v") {
+		name = strings.TrimPrefix(name, "v")
+	}
+	if len(m.Services) == 0 {
+		return Version{}, errorf(ErrNoServices, "There are no services to release.")
+	}
+	// Snapshot the services.
+	ss := map[string]string{}
+	var missing []string
+	for sn, s := range m.Services {
+		v, ok := s.Versions.Latest()
+		if !ok {
+			missing = append(missing, sn)
+			continue
+		}
+		ss[sn] = v.Name
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return Version{}, errorf(
+			ErrNoVersions,
+			"Services have no versions: %s. Promote a version of each first.",
+			strings.Join(missing, ", "),
+		)
+	}
+	// Record the release.
+	r := Version{
+		Name:         name,
+		Description:  description,
+		Date:         date,
+		Author:       author,
+		Services:     ss,
+		Incompatible: incompatible,
+	}
+	if _, exists := m.Versions.Find(r.Name); exists {
+		return Version{}, errorf(ErrVersionExists, "Version %s already exists.", r.Name)
+	}
+	m.Versions.Add(r)
+	m.CurrentRelease = ""
+	return r, nil
+}
@@ -0,0 +1,55 @@
+package many
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReleaseName(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases []string
+		category string
+		want     string
+	}{
+		{"first", nil, BumpMinor, "v0.1.0"},
+		{"prefixed", []string{"v1.0.0"}, BumpPatch, "v1.0.1"},
+		{"unprefixed", []string{"1.0.0"}, BumpPatch, "1.0.1"},
+		{"unprefixed major", []string{"0.9.0", "1.2.3"}, BumpMajor, "2.0.0"},
+		{"latest decides", []string{"v1.0.0", "1.1.0"}, BumpMinor, "1.2.0"},
+		{"pre-release", []string{"1.0.0-rc.1"}, BumpPatch, "1.0.0"},
+	}
+	d := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := Manyfile{Services: Services{
+				"api": {Name: "api", Versions: Versions{{Name: "1.0.0", Date: d}}},
+			}}
+			for _, r := range test.releases {
+				m.Versions.Add(Version{Name: r, Services: map[string]string{"api": "1.0.0"}})
+			}
+			v, err := m.Release(test.category, "", "alice", d, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Name != test.want {
+				t.Errorf("got release %s, want %s", v.Name, test.want)
+			}
+			if v.Services["api"] != "1.0.0" {
+				t.Errorf("got services %v", v.Services)
+			}
+		})
+	}
+}
+
+func TestReleaseNoVersions(t *testing.T) {
+	m := Manyfile{Services: Services{"api": {Name: "api"}, "web": {Name: "web"}}}
+	_, err := m.Release(BumpPatch, "", "alice", time.Now(), false)
+	if !errors.Is(err, ErrNoVersions) {
+		t.Fatalf("got error %v, want ErrNoVersions", err)
+	}
+	if len(m.Versions) != 0 {
+		t.Errorf("got versions %+v, want none", m.Versions)
+	}
+}
@@ -0,0 +1,125 @@
+package many
+
+import (
+	"strings"
+	"time"
+)
+
+// A rollback of the product or an environment to an earlier overall version.
+type Rollback struct {
+	// The environment rolled back, empty for the product.
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	From        string `json:"from" yaml:"from"`
+	To          string `json:"to" yaml:"to"`
+	// The services' versions before and after.
+	Diff ReleaseDiff `json:"diff" yaml:"diff"`
+}
+
+// Roll the product, or an environment if env is set, back to an earlier
+// overall version. Without a version the product goes back to the release
+// before the current one, and an environment to the last earlier release
+// deployed to it. Nothing is removed: the product's current release is set,
+// and a deployment is recorded for an environment. Rolling back past an
+// incompatible release is refused.
+func (m *Manyfile) Rollback(
+	env string,
+	to string,
+	author string,
+	date time.Time,
+) (Rollback, error) {
+	rb := Rollback{Environment: env}
+	// Find the version to roll back from.
+	var from Version
+	var e Environment
+	var err error
+	if env == "" {
+		from, err = m.Current()
+		if err != nil {
+			return Rollback{}, err
+		}
+	} else {
+		e, err = m.Environment(env)
+		if err != nil {
+			return Rollback{}, err
+		}
+		d, ok := e.Current()
+		if !ok {
+			return Rollback{}, errorf(
+				ErrNotDeployed,
+				"Nothing has been deployed to %s.",
+				env,
+			)
+		}
+		from, err = m.FindRelease(d.Release)
+		if err != nil {
+			return Rollback{}, err
+		}
+	}
+	// Find the version to roll back to.
+	var target Version
+	found := false
+	switch {
+	case to != "":
+		target, err = m.FindRelease(to)
+		if err != nil {
+			return Rollback{}, err
+		}
+		if CompareVersions(target, from) >= 0 {
+			return Rollback{}, errorf(
+				ErrInvalidVersion,
+				"Version %s is not before %s. Use release or deploy to move forward.",
+				to,
+				from.Name,
+			)
+		}
+		found = true
+	case env == "":
+		target, found = m.previousRelease(from)
+	default:
+		for i := len(e.Deployments) - 1; i >= 0 && !found; i-- {
+			v, ok := m.Versions.Find(e.Deployments[i].Release)
+			if ok && CompareVersions(v, from) < 0 {
+				target, found = v, true
+			}
+		}
+	}
+	if !found {
+		return Rollback{}, errorf(
+			ErrNoReleases,
+			"There is no release before %s to roll back to.",
+			from.Name,
+		)
+	}
+	// Releases after the target up to and including the current one can't
+	// be undone if they are incompatible.
+	var incompatible []string
+	for _, v := range m.Versions {
+		if v.Incompatible && CompareVersions(v, target) > 0 && CompareVersions(v, from) <= 0 {
+			incompatible = append(incompatible, v.Name)
+		}
+	}
+	if len(incompatible) > 0 {
+		return Rollback{}, errorf(
+			ErrIncompatible,
+			"Can't roll back from %s to %s past incompatible releases: %s.",
+			from.Name,
+			target.Name,
+			strings.Join(incompatible, ", "),
+		)
+	}
+	rb.From, rb.To = from.Name, target.Name
+	rb.Diff, err = m.DiffReleases(from.Name, target.Name)
+	if err != nil {
+		return Rollback{}, err
+	}
+	// Record the rollback.
+	if env == "" {
+		m.CurrentRelease = target.Name
+		return rb, nil
+	}
+	_, err = m.Deploy(env, target.Name, author, date)
+	if err != nil {
+		return Rollback{}, err
+	}
+	return rb, nil
+}
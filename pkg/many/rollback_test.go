@@ -0,0 +1,132 @@
+package many
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// A Manyfile with three releases, v1.1.0 incompatible if set, and
+// environments. prod had v1.0.0 then v1.2.0 deployed, staging nothing.
+func testRollbackManyfile(incompatible bool) Manyfile {
+	d := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := Manyfile{
+		Services: Services{"api": {Name: "api", Versions: Versions{
+			{Name: "1.0.0", Date: d},
+			{Name: "1.1.0", Date: d},
+			{Name: "1.2.0", Date: d},
+		}}},
+		Versions: Versions{
+			{Name: "v1.0.0", Services: map[string]string{"api": "1.0.0"}},
+			{Name: "v1.1.0", Services: map[string]string{"api": "1.1.0"}, Incompatible: incompatible},
+			{Name: "v1.2.0", Services: map[string]string{"api": "1.2.0"}},
+		},
+		Environments: Environments{
+			"prod": {Name: "prod", Deployments: Deployments{
+				{Release: "v1.0.0", Date: d, Services: map[string]string{"api": "1.0.0"}},
+				{Release: "v1.2.0", Date: d.Add(time.Hour), Services: map[string]string{"api": "1.2.0"}},
+			}},
+			"staging": {Name: "staging"},
+		},
+	}
+	return m
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name         string
+		incompatible bool
+		env          string
+		to           string
+		// The release rolled back to, or the error.
+		want string
+		err  error
+	}{
+		{"previous release", false, "", "", "v1.1.0", nil},
+		{"named release", false, "", "v1.0.0", "v1.0.0", nil},
+		{"current release", false, "", "v1.2.0", "", ErrInvalidVersion},
+		{"unknown release", false, "", "v0.9.0", "", ErrVersionNotFound},
+		{"past incompatible", true, "", "v1.0.0", "", ErrIncompatible},
+		{"to incompatible", true, "", "v1.1.0", "v1.1.0", nil},
+		{"environment", false, "prod", "", "v1.0.0", nil},
+		{"environment named", false, "prod", "v1.1.0", "v1.1.0", nil},
+		{"environment past incompatible", true, "prod", "", "", ErrIncompatible},
+		{"environment not deployed", false, "staging", "", "", ErrNotDeployed},
+		{"unknown environment", false, "test", "", "", ErrEnvironmentNotFound},
+	}
+	date := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testRollbackManyfile(test.incompatible)
+			rb, err := m.Rollback(test.env, test.to, "alice", date)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				if m.CurrentRelease != "" || len(m.Environments["prod"].Deployments) != 2 {
+					t.Error("failed rollback changed the Manyfile")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rb.To != test.want || rb.From != "v1.2.0" {
+				t.Errorf("got rollback from %s to %s, want v1.2.0 to %s", rb.From, rb.To, test.want)
+			}
+			// Nothing is removed.
+			if len(m.Versions) != 3 {
+				t.Errorf("got %d releases, want 3", len(m.Versions))
+			}
+			if test.env == "" {
+				if m.CurrentRelease != test.want {
+					t.Errorf("got current release %q, want %s", m.CurrentRelease, test.want)
+				}
+				if v, err := m.Current(); err != nil || v.Name != test.want {
+					t.Errorf("got current %s, %v", v.Name, err)
+				}
+				return
+			}
+			// The rollback is a new deployment.
+			ds := m.Environments[test.env].Deployments
+			if len(ds) != 3 {
+				t.Fatalf("got deployments %+v, want one added", ds)
+			}
+			d := ds[2]
+			if d.Release != test.want || d.Author != "alice" || !d.Date.Equal(date) {
+				t.Errorf("got deployment %+v", d)
+			}
+			if m.CurrentRelease != "" {
+				t.Errorf("product rolled back to %s", m.CurrentRelease)
+			}
+		})
+	}
+}
+
+func TestRollbackNothingEarlier(t *testing.T) {
+	m := Manyfile{Versions: Versions{{Name: "v1.0.0", Services: map[string]string{"api": "1.0.0"}}}}
+	_, err := m.Rollback("", "", "alice", time.Now())
+	if !errors.Is(err, ErrNoReleases) {
+		t.Fatalf("got error %v, want ErrNoReleases", err)
+	}
+}
+
+func TestReleaseAfterRollback(t *testing.T) {
+	m := testRollbackManyfile(false)
+	_, err := m.Rollback("", "", "alice", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new release is current again.
+	v, err := m.Release(BumpMinor, "", "alice", time.Now(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := m.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "v1.3.0" || c.Name != v.Name {
+		t.Errorf("released %s, current is %s", v.Name, c.Name)
+	}
+}
@@ -0,0 +1,196 @@
+package many
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+)
+
+// The version of the Manyfile format written by this package. Increment it
+// and add a migration whenever the format changes, so older binaries refuse
+// to overwrite files they don't fully understand.
+//
+// Version 1 is Manyfiles written before the format was versioned, which may
+// have capitalised service and version keys. Version 2 adds schema_version and
+// uses lower case keys throughout. Version 3 adds the digests of service
+// versions' Docker images. Version 4 adds environments and their deployments.
+// Version 5 adds incompatible releases and the release rolled back to.
+const SchemaVersion = 5
+
+// A migration upgrades a decoded Manyfile by one schema version.
+type migration func(raw map[string]interface{}) error
+
+// The migrations. The migration at index i upgrades from version i+1.
+var migrations = []migration{
+	migrate1To2,
+	migrate2To3,
+	migrate3To4,
+	migrate4To5,
+}
+
+// Get the schema version of a decoded Manyfile.
+func schemaVersion(raw map[string]interface{}) (int, error) {
+	v, ok := raw["schema_version"]
+	if !ok {
+		return 1, nil
+	}
+	// TOML decodes numbers as int64, JSON as float64 and YAML as int.
+	var n int
+	switch t := v.(type) {
+	case int64:
+		n = int(t)
+	case int:
+		n = t
+	case float64:
+		n = int(t)
+		if float64(n) != t {
+			n = 0
+		}
+	}
+	if n < 1 {
+		return 0, errorf(ErrInvalidManyfile, "Invalid schema version %v.", v)
+	}
+	return n, nil
+}
+
+// Migrate a decoded Manyfile to the current schema version. Manyfiles with a
+// newer schema version are left as they are.
+func migrate(raw map[string]interface{}) error {
+	v, err := schemaVersion(raw)
+	if err != nil {
+		return err
+	}
+	for ; v < SchemaVersion; v++ {
+		err = migrations[v-1](raw)
+		if err != nil {
+			return errorf(
+				ErrInvalidManyfile,
+				"Can't migrate from schema version %d: %s.",
+				v,
+				strings.TrimSuffix(err.Error(), "."),
+			)
+		}
+		raw["schema_version"] = int64(v + 1)
+	}
+	return nil
+}
+
+// Migrate an encoded Manyfile to the current schema version. Returns the
+// data as it is if it doesn't need migrating, and the schema version it had.
+func migrateData(c Codec, data []byte) ([]byte, int, error) {
+	var raw map[string]interface{}
+	err := c.Decode(data, &raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err := schemaVersion(raw)
+	if err != nil || v >= SchemaVersion {
+		return data, v, err
+	}
+	err = migrate(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	var b bytes.Buffer
+	err = c.Encode(&b, raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b.Bytes(), v, nil
+}
+
+// The keys of services and versions before they were lower case.
+var v1Keys = map[string]string{
+	"Name":        "name",
+	"Description": "description",
+	"Date":        "date",
+	"Author":      "author",
+	"Git":         "git",
+	"Docker":      "docker",
+	"Candidate":   "candidate",
+	"Versions":    "versions",
+}
+
+// Lower case the keys of services and versions.
+func migrate1To2(raw map[string]interface{}) error {
+	rename := func(t map[string]interface{}) {
+		for k, v := range t {
+			if n, ok := v1Keys[k]; ok {
+				delete(t, k)
+				t[n] = v
+			}
+		}
+	}
+	renameAll := func(ts interface{}) {
+		switch vs := ts.(type) {
+		case []map[string]interface{}:
+			for _, v := range vs {
+				rename(v)
+			}
+		case []interface{}:
+			for _, v := range vs {
+				if t, ok := v.(map[string]interface{}); ok {
+					rename(t)
+				}
+			}
+		}
+	}
+	renameAll(raw["versions"])
+	ss, _ := raw["services"].(map[string]interface{})
+	for _, s := range ss {
+		st, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rename(st)
+		if c, ok := st["candidate"].(map[string]interface{}); ok {
+			rename(c)
+		}
+		renameAll(st["versions"])
+	}
+	return nil
+}
+
+// Migrate a repo's Manyfile to the current schema version. Returns the file's
+// content before and after migrating. Nothing is written if dryRun is set.
+func (r *Repo) Migrate(dryRun bool) ([]byte, []byte, error) {
+	old, err := ioutil.ReadFile(r.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := CodecFor(r.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	var b bytes.Buffer
+	err = EncodeManyfile(&b, c, r.ManyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dryRun || bytes.Equal(old, b.Bytes()) {
+		return old, b.Bytes(), nil
+	}
+	err = r.Save()
+	if err != nil {
+		return nil, nil, err
+	}
+	return old, b.Bytes(), nil
+}
+
+// Nothing to change, digests are optional. The version is raised so older
+// binaries don't drop digests when they save.
+func migrate2To3(raw map[string]interface{}) error {
+	return nil
+}
+
+// Nothing to change, environments are optional. The version is raised so
+// older binaries don't drop environments when they save.
+func migrate3To4(raw map[string]interface{}) error {
+	return nil
+}
+
+// Nothing to change, both additions are optional. The version is raised so
+// older binaries don't drop a rollback when they save.
+func migrate4To5(raw map[string]interface{}) error {
+	return nil
+}
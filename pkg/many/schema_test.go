@@ -0,0 +1,169 @@
+package many
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A Manyfile as the first versions of many wrote it, with capitalised service
+// and version keys and no schema version.
+const testV1TOML = `name = "product"
+remote_url = "git@example.com:team/product.git"
+remote_name = "origin"
+
+[[versions]]
+  Name = "v1.0.0"
+  Description = "First release."
+  Date = 2019-06-01T12:00:00Z
+  Author = "alice"
+
+[services]
+  [services.api]
+    Name = "api"
+    Description = "The API."
+    Git = "git@example.com:team/api.git"
+    Docker = "example.com/team/api"
+    [services.api.Candidate]
+      Name = "1.1.0"
+      Description = "Faster."
+      Date = 0001-01-01T00:00:00Z
+      Author = ""
+
+    [[services.api.Versions]]
+      Name = "1.0.0"
+      Description = "Initial."
+      Date = 2019-06-01T12:00:00Z
+      Author = "bob"
+`
+
+// The same Manyfile in the other formats.
+const testV1JSON = `{
+  "name": "product",
+  "remote_url": "git@example.com:team/product.git",
+  "remote_name": "origin",
+  "versions": [
+    {"Name": "v1.0.0", "Description": "First release.", "Date": "2019-06-01T12:00:00Z", "Author": "alice"}
+  ],
+  "services": {
+    "api": {
+      "Name": "api",
+      "Description": "The API.",
+      "Git": "git@example.com:team/api.git",
+      "Docker": "example.com/team/api",
+      "Candidate": {"Name": "1.1.0", "Description": "Faster.", "Date": "0001-01-01T00:00:00Z", "Author": ""},
+      "Versions": [
+        {"Name": "1.0.0", "Description": "Initial.", "Date": "2019-06-01T12:00:00Z", "Author": "bob"}
+      ]
+    }
+  }
+}
+`
+
+const testV1YAML = `name: product
+remote_url: git@example.com:team/product.git
+remote_name: origin
+versions:
+- Name: v1.0.0
+  Description: First release.
+  Date: 2019-06-01T12:00:00Z
+  Author: alice
+services:
+  api:
+    Name: api
+    Description: The API.
+    Git: git@example.com:team/api.git
+    Docker: example.com/team/api
+    Candidate:
+      Name: 1.1.0
+      Description: Faster.
+      Date: 0001-01-01T00:00:00Z
+      Author: ""
+    Versions:
+    - Name: 1.0.0
+      Description: Initial.
+      Date: 2019-06-01T12:00:00Z
+      Author: bob
+`
+
+// The version 1 Manyfile migrated to the current schema version.
+func testV1Migrated() Manyfile {
+	d := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	return Manyfile{
+		SchemaVersion: SchemaVersion,
+		Name:          "product",
+		RemoteURL:     "git@example.com:team/product.git",
+		RemoteName:    "origin",
+		Versions: Versions{
+			{Name: "v1.0.0", Description: "First release.", Date: d, Author: "alice"},
+		},
+		Services: Services{
+			"api": {
+				Name:        "api",
+				Description: "The API.",
+				Git:         "git@example.com:team/api.git",
+				Docker:      "example.com/team/api",
+				Candidate:   Version{Name: "1.1.0", Description: "Faster."},
+				Versions: Versions{
+					{Name: "1.0.0", Description: "Initial.", Date: d, Author: "bob"},
+				},
+			},
+		},
+	}
+}
+
+func TestMigrateV1(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		data  string
+	}{
+		{"TOML", TOMLCodec{}, testV1TOML},
+		{"JSON", JSONCodec{}, testV1JSON},
+		{"YAML", YAMLCodec{}, testV1YAML},
+	}
+	want := testV1Migrated()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := DecodeManyfile(test.codec, []byte(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m, want) {
+				t.Fatalf("got %+v, want %+v", m, want)
+			}
+			// The migrated file reads back the same.
+			var b bytes.Buffer
+			err = EncodeManyfile(&b, test.codec, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err = DecodeManyfile(test.codec, b.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m, want) {
+				t.Errorf("got %+v after saving, want %+v", m, want)
+			}
+		})
+	}
+}
+
+func TestMigrateError(t *testing.T) {
+	m1 := migrations[0]
+	defer func() {
+		migrations[0] = m1
+	}()
+	migrations[0] = func(raw map[string]interface{}) error {
+		return errors.New("bad key.")
+	}
+	_, err := DecodeManyfile(TOMLCodec{}, []byte(testV1TOML))
+	if !errors.Is(err, ErrInvalidManyfile) {
+		t.Fatalf("got error %v, want ErrInvalidManyfile", err)
+	}
+	if want := "Can't migrate from schema version 1: bad key."; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,158 @@
+package many
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Release categories, the part of a semantic version to increment.
+const (
+	BumpPatch = "patch"
+	BumpMinor = "minor"
+	BumpMajor = "major"
+)
+
+// Semantic versions, from https://semver.org, with an optional "v" prefix.
+var semverRegexp = regexp.MustCompile(
+	`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+		`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)` +
+		`(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+		`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`,
+)
+
+// A semantic version.
+type Semver struct {
+	Major uint64
+	Minor uint64
+	Patch uint64
+	// Dot separated pre-release identifiers, for example "rc.1".
+	Prerelease string
+	// Dot separated build metadata. It is ignored when ordering versions.
+	Build string
+}
+
+// Parse a semantic version such as "1.2.3-rc.1+build.5". A "v" prefix is
+// allowed.
+func ParseSemver(s string) (Semver, error) {
+	var v Semver
+	ms := semverRegexp.FindStringSubmatch(s)
+	if ms == nil {
+		return v, errorf(ErrInvalidVersion, "Invalid semantic version %q.", s)
+	}
+	ns := make([]uint64, 3)
+	for i := range ns {
+		n, err := strconv.ParseUint(ms[i+1], 10, 64)
+		if err != nil {
+			return v, errorf(ErrInvalidVersion, "Invalid semantic version %q.", s)
+		}
+		ns[i] = n
+	}
+	v.Major, v.Minor, v.Patch = ns[0], ns[1], ns[2]
+	v.Prerelease, v.Build = ms[4], ms[5]
+	return v, nil
+}
+
+// Format the version with a "v" prefix.
+func (v Semver) String() string {
+	s := fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// Compare versions by precedence. Returns -1, 0 or 1 if the version is lower
+// than, equal to or higher than the other. Build metadata is ignored.
+func (v1 Semver) Compare(v2 Semver) int {
+	switch {
+	case v1.Major != v2.Major:
+		return compareUints(v1.Major, v2.Major)
+	case v1.Minor != v2.Minor:
+		return compareUints(v1.Minor, v2.Minor)
+	case v1.Patch != v2.Patch:
+		return compareUints(v1.Patch, v2.Patch)
+	}
+	// A pre-release is lower than the normal version.
+	switch {
+	case v1.Prerelease == v2.Prerelease:
+		return 0
+	case v1.Prerelease == "":
+		return 1
+	case v2.Prerelease == "":
+		return -1
+	}
+	// Compare pre-release identifiers from left to right.
+	p1 := strings.Split(v1.Prerelease, ".")
+	p2 := strings.Split(v2.Prerelease, ".")
+	for i := 0; i < len(p1) && i < len(p2); i++ {
+		if c := compareIdentifiers(p1[i], p2[i]); c != 0 {
+			return c
+		}
+	}
+	// More identifiers is higher.
+	return compareUints(uint64(len(p1)), uint64(len(p2)))
+}
+
+// Check if a version is lower than another.
+func (v1 Semver) Less(v2 Semver) bool {
+	return v1.Compare(v2) < 0
+}
+
+// Increment a part of the version, resetting the lower parts and dropping
+// the pre-release and build metadata. A pre-release of the version the
+// increment would produce is released instead, so a patch release of
+// v1.2.3-rc.1 is v1.2.3.
+func (v Semver) Bump(category string) (Semver, error) {
+	pre := v.Prerelease != ""
+	switch category {
+	case BumpPatch:
+		if pre {
+			return Semver{Major: v.Major, Minor: v.Minor, Patch: v.Patch}, nil
+		}
+		return Semver{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}, nil
+	case BumpMinor:
+		if pre && v.Patch == 0 {
+			return Semver{Major: v.Major, Minor: v.Minor}, nil
+		}
+		return Semver{Major: v.Major, Minor: v.Minor + 1}, nil
+	case BumpMajor:
+		if pre && v.Minor == 0 && v.Patch == 0 {
+			return Semver{Major: v.Major}, nil
+		}
+		return Semver{Major: v.Major + 1}, nil
+	}
+	return v, errorf(ErrInvalidCategory, "Unknown release category %s.", category)
+}
+
+// Compare pre-release identifiers. Numeric identifiers are compared
+// numerically and are lower than alphanumeric ones, which are compared
+// lexically.
+func compareIdentifiers(i1 string, i2 string) int {
+	n1, err1 := strconv.ParseUint(i1, 10, 64)
+	n2, err2 := strconv.ParseUint(i2, 10, 64)
+	switch {
+	case err1 == nil && err2 == nil:
+		return compareUints(n1, n2)
+	case err1 == nil:
+		return -1
+	case err2 == nil:
+		return 1
+	}
+	return strings.Compare(i1, i2)
+}
+
+// Compare unsigned integers.
+func compareUints(n1 uint64, n2 uint64) int {
+	switch {
+	case n1 < n2:
+		return -1
+	case n1 > n2:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package many
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	d1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	d2 := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		v1, v2 Version
+		want   int
+	}{
+		// Numeric parts are compared as numbers.
+		{Version{Name: "v1.9.0"}, Version{Name: "v1.10.0"}, -1},
+		{Version{Name: "1.2.10"}, Version{Name: "1.2.9"}, 1},
+		{Version{Name: "v2.0.0"}, Version{Name: "v10.0.0"}, -1},
+		{Version{Name: "v1.0.0"}, Version{Name: "v1.0.0"}, 0},
+		// Pre-releases, ordered as in https://semver.org.
+		{Version{Name: "v1.0.0-alpha"}, Version{Name: "v1.0.0-alpha.1"}, -1},
+		{Version{Name: "v1.0.0-alpha.1"}, Version{Name: "v1.0.0-alpha.beta"}, -1},
+		{Version{Name: "v1.0.0-alpha.beta"}, Version{Name: "v1.0.0-beta"}, -1},
+		{Version{Name: "v1.0.0-beta"}, Version{Name: "v1.0.0-beta.2"}, -1},
+		{Version{Name: "v1.0.0-beta.2"}, Version{Name: "v1.0.0-beta.11"}, -1},
+		{Version{Name: "v1.0.0-beta.11"}, Version{Name: "v1.0.0-rc.1"}, -1},
+		{Version{Name: "v1.0.0-rc.1"}, Version{Name: "v1.0.0"}, -1},
+		// Build metadata doesn't change precedence.
+		{Version{Name: "v1.0.0+build.9"}, Version{Name: "v1.0.1"}, -1},
+		{Version{Name: "v1.0.0-rc.1+build.9"}, Version{Name: "v1.0.0"}, -1},
+		// Other names are ordered by date, before semantic versions.
+		{Version{Name: "f00d", Date: d1}, Version{Name: "abcd", Date: d2}, -1},
+		{Version{Name: "abcd", Date: d2}, Version{Name: "f00d", Date: d1}, 1},
+		{Version{Name: "abcd", Date: d1}, Version{Name: "f00d", Date: d1}, -1},
+		{Version{Name: "abcd", Date: d2}, Version{Name: "v0.0.1", Date: d1}, -1},
+		{Version{Name: "v0.0.1", Date: d1}, Version{Name: "abcd", Date: d2}, 1},
+	}
+	for _, test := range tests {
+		got := CompareVersions(test.v1, test.v2)
+		if got != test.want {
+			t.Errorf("CompareVersions(%s, %s) = %d, want %d", test.v1.Name, test.v2.Name, got, test.want)
+		}
+	}
+}
+
+func TestSemverCompareIgnoresBuild(t *testing.T) {
+	v1, err := ParseSemver("v1.2.3+build.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := ParseSemver("1.2.3+build.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := v1.Compare(v2); c != 0 {
+		t.Errorf("got %d, want 0", c)
+	}
+}
@@ -0,0 +1,267 @@
+package many
+
+import (
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// Service names are used as TOML keys and in image and tag names.
+	serviceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	// SCP-like git URLs, for example "git@github.com:rubberydub/many.git".
+	scpURLRegexp = regexp.MustCompile(`^(?:[A-Za-z0-9._-]+@)?[A-Za-z0-9.-]+:[^/\\].*$`)
+	// Docker repository names, without a tag or digest. See the grammar in
+	// github.com/docker/distribution/reference.
+	dockerRepoRegexp = regexp.MustCompile(
+		`^(?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])` +
+			`(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*` +
+			`(?::[0-9]+)?/)?` +
+			`[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*` +
+			`(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*$`,
+	)
+	// Git URL schemes.
+	gitSchemes = map[string]bool{
+		"http":    true,
+		"https":   true,
+		"ssh":     true,
+		"git":     true,
+		"git+ssh": true,
+		"ssh+git": true,
+		"file":    true,
+	}
+)
+
+// Validate a service name.
+func validateServiceName(n string) error {
+	if !serviceNameRegexp.MatchString(n) {
+		return errorf(
+			ErrInvalidService,
+			"Invalid service name %q. Use letters, digits, '.', '_' and '-'.",
+			n,
+		)
+	}
+	return nil
+}
+
+// Validate a git repository URL. URLs, SCP-like addresses and absolute local
+// paths are accepted.
+func validateGitURL(u string) error {
+	// Absolute local paths.
+	if filepath.IsAbs(u) {
+		return nil
+	}
+	// URLs with a scheme.
+	if strings.Contains(u, "://") {
+		p, err := url.Parse(u)
+		if err != nil {
+			return errorf(ErrInvalidService, "Invalid git URL %q: %s.", u, err)
+		}
+		if !gitSchemes[p.Scheme] {
+			return errorf(ErrInvalidService, "Invalid git URL %q: unsupported scheme %s.", u, p.Scheme)
+		}
+		if p.Scheme != "file" && p.Host == "" {
+			return errorf(ErrInvalidService, "Invalid git URL %q: missing host.", u)
+		}
+		if strings.Trim(p.Path, "/") == "" {
+			return errorf(ErrInvalidService, "Invalid git URL %q: missing path.", u)
+		}
+		return nil
+	}
+	// SCP-like addresses.
+	if scpURLRegexp.MatchString(u) {
+		return nil
+	}
+	return errorf(ErrInvalidService, "Invalid git URL %q.", u)
+}
+
+// Validate a Docker repository reference, for example
+// "registry.example.com:5000/team/backend". Tags and digests are not allowed
+// since they come from the service's versions.
+func validateDockerRepo(r string) error {
+	if len(r) > 255 {
+		return errorf(ErrInvalidService, "Invalid Docker repository %q: too long.", r)
+	}
+	if strings.Contains(r, "@") {
+		return errorf(ErrInvalidService, "Invalid Docker repository %q: remove the digest.", r)
+	}
+	// A colon after the last slash is a tag.
+	if i := strings.LastIndex(r, ":"); i > strings.LastIndex(r, "/") {
+		return errorf(ErrInvalidService, "Invalid Docker repository %q: remove the tag.", r)
+	}
+	if !dockerRepoRegexp.MatchString(r) {
+		return errorf(ErrInvalidService, "Invalid Docker repository %q.", r)
+	}
+	return nil
+}
+
+// Validate a service's details.
+func (s Service) Validate() error {
+	err := validateServiceName(s.Name)
+	if err != nil {
+		return err
+	}
+	if s.Git != "" {
+		err = validateGitURL(s.Git)
+		if err != nil {
+			return err
+		}
+	}
+	if s.Docker != "" {
+		err = validateDockerRepo(s.Docker)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register a service. An existing service is an error unless update is set,
+// in which case the details are merged into it. Returns true if the service
+// was created.
+func (m *Manyfile) CreateService(s Service, update bool) (bool, error) {
+	err := s.Validate()
+	if err != nil {
+		return false, err
+	}
+	// Refuse names that differ only by case, they are easily confused.
+	for n := range m.Services {
+		if n != s.Name && strings.EqualFold(n, s.Name) {
+			return false, errorf(
+				ErrServiceExists,
+				"Service %s collides with existing service %s.",
+				s.Name,
+				n,
+			)
+		}
+	}
+	if m.Services == nil {
+		m.Services = Services{}
+	}
+	// Create the service.
+	e, ok := m.Services[s.Name]
+	if !ok {
+		m.Services[s.Name] = s
+		return true, nil
+	}
+	// The service exists, update it if flagged.
+	if !update {
+		return false, errorf(
+			ErrServiceExists,
+			"Service %s already exists. Use --update to update it.",
+			s.Name,
+		)
+	}
+	err = e.Merge(s)
+	if err != nil {
+		return false, err
+	}
+	m.Services[s.Name] = e
+	return false, nil
+}
+
+// Check if two versions have the same content, ignoring when and by whom they
+// were recorded.
+func sameContent(v1 Version, v2 Version) bool {
+	return v1.Name == v2.Name && v1.Description == v2.Description
+}
+
+// The outcome of setting a service's candidate.
+type CandidateResult int
+
+const (
+	// The candidate was set.
+	CandidateSet CandidateResult = iota
+	// The version already was the candidate.
+	CandidateUnchanged
+	// The version was already promoted, so it wasn't made the candidate.
+	CandidatePromoted
+)
+
+// Set a service's candidate, the version to be promoted next. Setting the
+// version that already is the candidate, or one that was already promoted,
+// leaves the service as it is, so retried CI jobs can set the candidate
+// again safely.
+func (m *Manyfile) SetCandidate(service string, c Version) (CandidateResult, error) {
+	s, err := m.Service(service)
+	if err != nil {
+		return 0, err
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		return 0, errorf(ErrInvalidVersion, "Candidate of service %s has no version.", service)
+	}
+	if s.Candidate.Name == c.Name {
+		return CandidateUnchanged, nil
+	}
+	if _, ok := s.Versions.Find(c.Name); ok {
+		return CandidatePromoted, nil
+	}
+	s.Candidate = c
+	m.Services[service] = s
+	return CandidateSet, nil
+}
+
+// Promote a service's candidate to a version, stamped with the date and
+// author. The version must be the candidate's name, so a stale promotion
+// can't promote a newer candidate. Promoting a version that already exists
+// with the same content does nothing, with different content it is an error.
+// The candidate is cleared unless keep is set. Returns true if the version
+// was added.
+func (m *Manyfile) Promote(
+	service string,
+	version string,
+	author string,
+	date time.Time,
+	keep bool,
+) (bool, error) {
+	s, err := m.Service(service)
+	if err != nil {
+		return false, err
+	}
+	// Check the version is the candidate.
+	c := s.Candidate
+	if c.Name == "" {
+		return false, errorf(ErrNoCandidate, "Service %s has no candidate.", service)
+	}
+	if c.Name != version {
+		return false, errorf(
+			ErrNotCandidate,
+			"Version %s is not the candidate of service %s, %s is.",
+			version,
+			service,
+			c.Name,
+		)
+	}
+	// Check for an existing version.
+	e, exists := s.Versions.Find(version)
+	if exists && !sameContent(e, c) {
+		return false, errorf(
+			ErrVersionExists,
+			"Version %s of service %s already exists with different content.",
+			version,
+			service,
+		)
+	}
+	// Add the version.
+	if !exists {
+		c.Date = date
+		c.Author = author
+		s.Versions.Add(c)
+	}
+	if !keep {
+		s.Candidate = Version{}
+	}
+	m.Services[service] = s
+	return !exists, nil
+}
+
+// Get a service by name.
+func (m Manyfile) Service(name string) (Service, error) {
+	s, ok := m.Services[name]
+	if !ok {
+		return Service{}, errorf(ErrServiceNotFound, "Unknown service %s.", name)
+	}
+	return s, nil
+}
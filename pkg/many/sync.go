@@ -0,0 +1,453 @@
+package many
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// The outcome of synchronising a repo with its remote.
+type SyncResult int
+
+const (
+	// There was nothing to pull or push.
+	SyncUpToDate SyncResult = iota
+	// The local branch was fast-forwarded to the remote branch.
+	SyncFastForwarded
+	// Local changes were pushed to the remote.
+	SyncPushed
+	// Diverged local and remote histories were merged.
+	SyncMerged
+)
+
+// The Manyfile's path relative to the repo, as git expects it.
+func (r *Repo) relFile() (string, error) {
+	p, err := filepath.Rel(r.Path, r.File)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(p), nil
+}
+
+// Read the Manyfile as it was at a git revision.
+func (r *Repo) ManyfileAt(rev string) (Manyfile, error) {
+	p, err := r.relFile()
+	if err != nil {
+		return Manyfile{}, err
+	}
+	c, err := CodecFor(r.File)
+	if err != nil {
+		return Manyfile{}, err
+	}
+	out, err := gitRaw(r.Path, "show", rev+":"+p)
+	if err != nil {
+		return Manyfile{}, err
+	}
+	return DecodeManyfile(c, []byte(out))
+}
+
+// Check the repo is a git repository with the Manyfile's remote and return
+// the current branch.
+func (r *Repo) prepareSync() (string, error) {
+	if !isGitRepo(r.Path) {
+		return "", errorf(ErrNotGitRepo, "%s is not a git repository.", r.Path)
+	}
+	if r.ManyFile.RemoteName == "" || r.ManyFile.RemoteURL == "" {
+		return "", errorf(
+			ErrNoRemote,
+			"Manyfile has no remote. Use init --update to set it.",
+		)
+	}
+	err := ensureRemote(r.Path, r.ManyFile.RemoteName, r.ManyFile.RemoteURL)
+	if err != nil {
+		return "", err
+	}
+	return currentBranch(r.Path)
+}
+
+// Get the paths in the repo with uncommitted changes, ignoring a lock file
+// taken before the repo was a git repository.
+func (r *Repo) changedPaths() ([]string, error) {
+	ps, err := changedPaths(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	var cs []string
+	for _, p := range ps {
+		if p != LockFile {
+			cs = append(cs, p)
+		}
+	}
+	return cs, nil
+}
+
+// Fetch a branch from the repo's remote. Returns the remote tracking ref, or
+// an empty string if the remote doesn't have the branch.
+func (r *Repo) fetch(branch string) (string, error) {
+	remote := r.ManyFile.RemoteName
+	out, err := git(r.Path, "ls-remote", "--heads", remote, branch)
+	if err != nil {
+		return "", err
+	}
+	if out == "" {
+		return "", nil
+	}
+	_, err = git(r.Path, "fetch", "--quiet", remote, branch)
+	if err != nil {
+		return "", err
+	}
+	return "refs/remotes/" + remote + "/" + branch, nil
+}
+
+// Pull changes from the remote Many repository. The working tree must not
+// have uncommitted changes, push commits those to the Manyfile. If the local
+// and remote histories have diverged the Manyfiles are merged with Merge3 and
+// the result is committed, unless there are conflicts.
+func (r *Repo) Pull() (SyncResult, error) {
+	branch, err := r.prepareSync()
+	if err != nil {
+		return 0, err
+	}
+	err = r.checkClean(nil)
+	if err != nil {
+		return 0, err
+	}
+	// Fetch the remote branch.
+	ref, err := r.fetch(branch)
+	if err != nil {
+		return 0, err
+	}
+	if ref == "" {
+		return SyncUpToDate, nil
+	}
+	// A new repository can always be fast-forwarded.
+	if hasCommits(r.Path) {
+		// Compare the local and remote histories.
+		behind, err := countCommits(r.Path, "HEAD", ref)
+		if err != nil {
+			return 0, err
+		}
+		if behind == 0 {
+			return SyncUpToDate, nil
+		}
+		ahead, err := countCommits(r.Path, ref, "HEAD")
+		if err != nil {
+			return 0, err
+		}
+		if ahead > 0 {
+			return r.merge(ref)
+		}
+	}
+	// Fast-forward.
+	_, err = git(r.Path, "merge", "--quiet", "--ff-only", ref)
+	if err != nil {
+		return 0, err
+	}
+	// Reload the Manyfile.
+	err = r.Reload()
+	if err != nil {
+		return 0, err
+	}
+	return SyncFastForwarded, nil
+}
+
+// Merge a diverged remote tracking ref into the current branch.
+func (r *Repo) merge(ref string) (SyncResult, error) {
+	p, err := r.relFile()
+	if err != nil {
+		return 0, err
+	}
+	// Get the common ancestor's Manyfile. It may not have one.
+	mb, err := git(r.Path, "merge-base", "HEAD", ref)
+	if err != nil {
+		return 0, errorf(
+			ErrNoCommonAncestor,
+			"Local and remote histories have no common ancestor.",
+		)
+	}
+	base, err := r.ManyfileAt(mb)
+	if err != nil {
+		base = Manyfile{Services: Services{}}
+	}
+	// Get their Manyfile.
+	theirs, err := r.ManyfileAt(ref)
+	if err != nil {
+		return 0, err
+	}
+	// Merge the Manyfiles before touching the work tree, so conflicts leave
+	// it as it was.
+	m, err := Merge3(base, r.ManyFile, theirs)
+	if err != nil {
+		return 0, err
+	}
+	// Merge the rest of the history. Textual conflicts in the Manyfile are
+	// expected and resolved below, any others are not.
+	_, err = git(r.Path, "merge", "--quiet", "--no-ff", "--no-commit", ref)
+	if err != nil {
+		if !hasMergeHead(r.Path) {
+			return 0, err
+		}
+		out, err := git(r.Path, "diff", "--name-only", "--diff-filter=U")
+		if err != nil {
+			return 0, err
+		}
+		for _, u := range strings.Split(out, "\n") {
+			if u != "" && u != p {
+				git(r.Path, "merge", "--abort")
+				return 0, errorf(ErrMergeConflict, "Merge has conflicts in %s.", u)
+			}
+		}
+	}
+	// Write the merged Manyfile and commit the merge. The Manyfile on disk
+	// was changed by git.
+	err = r.track()
+	if err != nil {
+		git(r.Path, "merge", "--abort")
+		return 0, err
+	}
+	r.ManyFile = m
+	err = r.Save()
+	if err != nil {
+		git(r.Path, "merge", "--abort")
+		return 0, err
+	}
+	_, err = git(r.Path, "add", "--", p)
+	if err != nil {
+		return 0, err
+	}
+	_, err = git(r.Path, "commit", "--quiet", "--no-edit")
+	if err != nil {
+		return 0, err
+	}
+	return SyncMerged, nil
+}
+
+// Commit changes to the Manyfile and push them to the remote Many repository.
+// If the message is empty one is generated from the changes. Other files in
+// the working tree must not have changes.
+func (r *Repo) Push(message string) (SyncResult, error) {
+	branch, err := r.prepareSync()
+	if err != nil {
+		return 0, err
+	}
+	// Commit the Manyfile first, so a pull can merge it if the remote has
+	// changed.
+	err = r.commitManyfile(message)
+	if err != nil {
+		return 0, err
+	}
+	// Fetch the remote branch.
+	ref, err := r.fetch(branch)
+	if err != nil {
+		return 0, err
+	}
+	// Refuse to push if the remote has commits we don't.
+	if ref != "" {
+		behind := 1
+		if hasCommits(r.Path) {
+			behind, err = countCommits(r.Path, "HEAD", ref)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if behind > 0 {
+			return 0, errorf(
+				ErrDiverged,
+				"Remote has changes that are not in the local repository. Use pull first.",
+			)
+		}
+	}
+	// Check there is something to push.
+	if !hasCommits(r.Path) {
+		return SyncUpToDate, nil
+	}
+	if ref != "" {
+		ahead, err := countCommits(r.Path, ref, "HEAD")
+		if err != nil {
+			return 0, err
+		}
+		if ahead == 0 {
+			return SyncUpToDate, nil
+		}
+	}
+	// Push.
+	_, err = git(
+		r.Path,
+		"push",
+		"--quiet",
+		"--set-upstream",
+		r.ManyFile.RemoteName,
+		branch,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return SyncPushed, nil
+}
+
+// Refuse to continue if files in the working tree other than those given have
+// uncommitted changes.
+func (r *Repo) checkClean(except []string) error {
+	ps, err := r.changedPaths()
+	if err != nil {
+		return err
+	}
+	var others []string
+	for _, c := range ps {
+		skip := false
+		for _, e := range except {
+			skip = skip || c == e
+		}
+		if !skip {
+			others = append(others, c)
+		}
+	}
+	if len(others) > 0 {
+		return errorf(
+			ErrDirtyWorkTree,
+			"Working tree has uncommitted changes: %s. Commit or discard them first.",
+			strings.Join(others, ", "),
+		)
+	}
+	return nil
+}
+
+// Commit uncommitted changes to the Manyfile. If the message is empty one is
+// generated from the changes. Other files must not have changes.
+func (r *Repo) commitManyfile(message string) error {
+	p, err := r.relFile()
+	if err != nil {
+		return err
+	}
+	err = r.checkClean([]string{p})
+	if err != nil {
+		return err
+	}
+	ps, err := r.changedPaths()
+	if err != nil || len(ps) == 0 {
+		return err
+	}
+	if message == "" {
+		message, err = r.commitMessage()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = git(r.Path, "add", "--", p)
+	if err != nil {
+		return err
+	}
+	_, err = git(r.Path, "commit", "--quiet", "-m", message, "--", p)
+	return err
+}
+
+// Generate a commit message describing the changes to the Manyfile since the
+// last commit.
+func (r *Repo) commitMessage() (string, error) {
+	if !hasCommits(r.Path) {
+		return fmt.Sprintf("Create Many repository %s", r.ManyFile.Name), nil
+	}
+	old, err := r.ManyfileAt("HEAD")
+	if err != nil {
+		// The Manyfile is new.
+		return fmt.Sprintf("Create Many repository %s", r.ManyFile.Name), nil
+	}
+	cs := describeChanges(old, r.ManyFile)
+	switch len(cs) {
+	case 0:
+		return "Update Many repository", nil
+	case 1:
+		return cs[0], nil
+	}
+	return fmt.Sprintf(
+		"Update Many repository\n\n- %s",
+		strings.Join(cs, "\n- "),
+	), nil
+}
+
+// Describe the changes between two Manyfiles, one line per change.
+func describeChanges(m1 Manyfile, m2 Manyfile) []string {
+	var cs []string
+	if m1.Name != m2.Name {
+		cs = append(cs, fmt.Sprintf("Rename repository to %s", m2.Name))
+	}
+	if m1.RemoteURL != m2.RemoteURL || m1.RemoteName != m2.RemoteName {
+		cs = append(cs, fmt.Sprintf("Set remote %s to %s", m2.RemoteName, m2.RemoteURL))
+	}
+	for _, v := range addedVersions(m1.Versions, m2.Versions) {
+		cs = append(cs, fmt.Sprintf("Release %s", v.Name))
+	}
+	if m2.CurrentRelease != "" && m1.CurrentRelease != m2.CurrentRelease {
+		cs = append(cs, fmt.Sprintf("Roll back to %s", m2.CurrentRelease))
+	}
+	// Services, in name order.
+	ns := sortedKeys(func(add func(string)) {
+		for _, ss := range []Services{m1.Services, m2.Services} {
+			for n := range ss {
+				add(n)
+			}
+		}
+	})
+	for _, n := range ns {
+		s1, ok1 := m1.Services[n]
+		s2, ok2 := m2.Services[n]
+		switch {
+		case !ok2:
+			cs = append(cs, fmt.Sprintf("Delete service %s", n))
+			continue
+		case !ok1:
+			cs = append(cs, fmt.Sprintf("Create service %s", n))
+		case s1.Description != s2.Description || s1.Git != s2.Git ||
+			s1.Docker != s2.Docker:
+			cs = append(cs, fmt.Sprintf("Update service %s", n))
+		}
+		if s2.Candidate.Name != "" && s1.Candidate.Name != s2.Candidate.Name {
+			cs = append(cs, fmt.Sprintf("Set %s candidate to %s", n, s2.Candidate.Name))
+		}
+		for _, v := range addedVersions(s1.Versions, s2.Versions) {
+			cs = append(cs, fmt.Sprintf("Promote %s to %s", n, v.Name))
+		}
+	}
+	// Environments, in name order.
+	ns = sortedKeys(func(add func(string)) {
+		for _, es := range []Environments{m1.Environments, m2.Environments} {
+			for n := range es {
+				add(n)
+			}
+		}
+	})
+	for _, n := range ns {
+		e1, ok1 := m1.Environments[n]
+		e2, ok2 := m2.Environments[n]
+		switch {
+		case !ok2:
+			cs = append(cs, fmt.Sprintf("Delete environment %s", n))
+			continue
+		case !ok1:
+			cs = append(cs, fmt.Sprintf("Add environment %s", n))
+		case e1.Description != e2.Description:
+			cs = append(cs, fmt.Sprintf("Update environment %s", n))
+		}
+		for _, d := range e2.Deployments {
+			if !e1.Deployments.contains(d) {
+				cs = append(cs, fmt.Sprintf("Deploy %s to %s", d.Release, n))
+			}
+		}
+	}
+	return cs
+}
+
+// Get the versions in one collection that are not in another, by name.
+func addedVersions(vs1 Versions, vs2 Versions) Versions {
+	ns := map[string]bool{}
+	for _, v := range vs1 {
+		ns[v.Name] = true
+	}
+	var a Versions
+	for _, v := range vs2 {
+		if !ns[v.Name] {
+			a = append(a, v)
+		}
+	}
+	return a
+}
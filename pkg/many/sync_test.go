@@ -0,0 +1,208 @@
+package many
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Initialise a Many repo with a remote, cloning the remote's Manyfile if it
+// has one.
+func testClone(t *testing.T, remote string) string {
+	t.Helper()
+	p := filepath.Join(testTempDir(t), "repo")
+	_, err := InitRepo(p, DefaultManyfile, "product", remote, "origin", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Change a repo's Manyfile, failing the test if it fails.
+func testUpdate(t *testing.T, repo string, fn func(m *Manyfile) error) {
+	t.Helper()
+	_, err := UpdateRepo(repo, DefaultManyfile, 0, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Set a service's candidate.
+func testSetCandidate(service string, version string) func(m *Manyfile) error {
+	return func(m *Manyfile) error {
+		if _, ok := m.Services[service]; !ok {
+			_, err := m.CreateService(Service{Name: service}, false)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := m.SetCandidate(service, Version{Name: version})
+		return err
+	}
+}
+
+// Push a repo, failing the test unless the result is the one given.
+func testPush(t *testing.T, repo string, want SyncResult) {
+	t.Helper()
+	r, err := LoadRepo(repo, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := r.Push("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != want {
+		t.Fatalf("got push result %v, want %v", res, want)
+	}
+}
+
+// Pull a repo.
+func testPull(t *testing.T, repo string) (*Repo, SyncResult, error) {
+	t.Helper()
+	r, err := LoadRepo(repo, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := r.Pull()
+	return r, res, err
+}
+
+func TestPullFastForward(t *testing.T) {
+	remote := testRemote(t)
+	first := testClone(t, remote)
+	testUpdate(t, first, testSetCandidate("api", "abc"))
+	testPush(t, first, SyncPushed)
+	testPush(t, first, SyncUpToDate)
+	second := testClone(t, remote)
+	testUpdate(t, first, testSetCandidate("api", "def"))
+	testPush(t, first, SyncPushed)
+	r, res, err := testPull(t, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != SyncFastForwarded {
+		t.Errorf("got pull result %v, want SyncFastForwarded", res)
+	}
+	if c := r.ManyFile.Services["api"].Candidate.Name; c != "def" {
+		t.Errorf("got candidate %q, want def", c)
+	}
+	_, res, err = testPull(t, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != SyncUpToDate {
+		t.Errorf("got pull result %v, want SyncUpToDate", res)
+	}
+}
+
+func TestPushDivergedThenMerge(t *testing.T) {
+	remote := testRemote(t)
+	first := testClone(t, remote)
+	testPush(t, first, SyncPushed)
+	second := testClone(t, remote)
+	testUpdate(t, first, testSetCandidate("api", "abc"))
+	testPush(t, first, SyncPushed)
+	// The remote has moved on, so the push is refused. The change is
+	// committed, ready to be merged.
+	testUpdate(t, second, testSetCandidate("web", "def"))
+	r, err := LoadRepo(second, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Push("")
+	if !errors.Is(err, ErrDiverged) {
+		t.Fatalf("got error %v, want ErrDiverged", err)
+	}
+	r, res, err := testPull(t, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != SyncMerged {
+		t.Errorf("got pull result %v, want SyncMerged", res)
+	}
+	for s, c := range map[string]string{"api": "abc", "web": "def"} {
+		if got := r.ManyFile.Services[s].Candidate.Name; got != c {
+			t.Errorf("got %s candidate %q, want %s", s, got, c)
+		}
+	}
+	testPush(t, second, SyncPushed)
+	r, res, err = testPull(t, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != SyncFastForwarded || r.ManyFile.Services["web"].Candidate.Name != "def" {
+		t.Errorf("got pull result %v and services %+v", res, r.ManyFile.Services)
+	}
+}
+
+func TestPullConflict(t *testing.T) {
+	remote := testRemote(t)
+	first := testClone(t, remote)
+	testUpdate(t, first, testSetCandidate("api", "abc"))
+	testPush(t, first, SyncPushed)
+	second := testClone(t, remote)
+	testUpdate(t, first, testSetCandidate("api", "def"))
+	testPush(t, first, SyncPushed)
+	testUpdate(t, second, testSetCandidate("api", "ghi"))
+	r, err := LoadRepo(second, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Push("")
+	if !errors.Is(err, ErrDiverged) {
+		t.Fatalf("got error %v, want ErrDiverged", err)
+	}
+	head := testGit(t, second, "rev-parse", "HEAD")
+	_, _, err = testPull(t, second)
+	if !errors.Is(err, ErrMergeConflict) {
+		t.Fatalf("got error %v, want ErrMergeConflict", err)
+	}
+	// Nothing is changed.
+	if h := testGit(t, second, "rev-parse", "HEAD"); h != head {
+		t.Errorf("HEAD moved from %s to %s", head, h)
+	}
+	if hasMergeHead(second) {
+		t.Error("merge is in progress")
+	}
+	r, err = LoadRepo(second, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := r.ManyFile.Services["api"].Candidate.Name; c != "ghi" {
+		t.Errorf("got candidate %q, want ghi", c)
+	}
+}
+
+func TestSyncDirtyWorkTree(t *testing.T) {
+	remote := testRemote(t)
+	repo := testClone(t, remote)
+	testPush(t, repo, SyncPushed)
+	// Pull refuses uncommitted changes to the Manyfile.
+	testUpdate(t, repo, testSetCandidate("api", "abc"))
+	head := testGit(t, repo, "rev-parse", "HEAD")
+	_, _, err := testPull(t, repo)
+	if !errors.Is(err, ErrDirtyWorkTree) {
+		t.Fatalf("got error %v, want ErrDirtyWorkTree", err)
+	}
+	if h := testGit(t, repo, "rev-parse", "HEAD"); h != head {
+		t.Error("pull committed the Manyfile")
+	}
+	// Both refuse changes to other files.
+	err = ioutil.WriteFile(filepath.Join(repo, "notes.txt"), []byte("notes\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRepo(repo, DefaultManyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Push("")
+	if !errors.Is(err, ErrDirtyWorkTree) {
+		t.Errorf("got error %v from push, want ErrDirtyWorkTree", err)
+	}
+	if h := testGit(t, repo, "rev-parse", "HEAD"); h != head {
+		t.Error("push committed with other files changed")
+	}
+}
@@ -0,0 +1,116 @@
+package many
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// A version for display.
+type VersionView struct {
+	Name        string    `json:"name" yaml:"name"`
+	Description string    `json:"description,omitempty" yaml:"description,omitempty"`
+	Date        time.Time `json:"date" yaml:"date"`
+	Author      string    `json:"author,omitempty" yaml:"author,omitempty"`
+	Digest      string    `json:"digest,omitempty" yaml:"digest,omitempty"`
+	// The version of each service in an overall version.
+	Services     map[string]string `json:"services,omitempty" yaml:"services,omitempty"`
+	Incompatible bool              `json:"incompatible,omitempty" yaml:"incompatible,omitempty"`
+}
+
+// A service for display.
+type ServiceView struct {
+	Name        string        `json:"name" yaml:"name"`
+	Description string        `json:"description,omitempty" yaml:"description,omitempty"`
+	Git         string        `json:"git,omitempty" yaml:"git,omitempty"`
+	Docker      string        `json:"docker,omitempty" yaml:"docker,omitempty"`
+	Candidate   *VersionView  `json:"candidate,omitempty" yaml:"candidate,omitempty"`
+	Versions    []VersionView `json:"versions" yaml:"versions"`
+}
+
+// Create a view of a version.
+func NewVersionView(v Version) VersionView {
+	return VersionView{
+		Name:         v.Name,
+		Description:  v.Description,
+		Date:         v.Date,
+		Author:       v.Author,
+		Digest:       v.Digest,
+		Services:     v.Services,
+		Incompatible: v.Incompatible,
+	}
+}
+
+// Create a view of a service with its most recent versions, newest first. A
+// limit of zero includes all versions.
+func NewServiceView(s Service, limit int) ServiceView {
+	sv := ServiceView{
+		Name:        s.Name,
+		Description: s.Description,
+		Git:         s.Git,
+		Docker:      s.Docker,
+		Versions:    []VersionView{},
+	}
+	if s.Candidate.Name != "" {
+		c := NewVersionView(s.Candidate)
+		sv.Candidate = &c
+	}
+	// Sort a copy of the versions by date, newest first.
+	vs := make(Versions, len(s.Versions))
+	copy(vs, s.Versions)
+	sort.SliceStable(vs, func(i, j int) bool {
+		return vs[i].Date.After(vs[j].Date)
+	})
+	if limit > 0 && len(vs) > limit {
+		vs = vs[:limit]
+	}
+	for _, v := range vs {
+		sv.Versions = append(sv.Versions, NewVersionView(v))
+	}
+	return sv
+}
+
+// Get views of services by name, in the order given. All unknown names are
+// reported in the error.
+func (m Manyfile) ViewServices(names []string, limit int) ([]ServiceView, error) {
+	var svs []ServiceView
+	var unknown []string
+	for _, n := range names {
+		s, ok := m.Services[n]
+		if !ok {
+			unknown = append(unknown, n)
+			continue
+		}
+		svs = append(svs, NewServiceView(s, limit))
+	}
+	if len(unknown) > 0 {
+		return nil, errorf(
+			ErrServiceNotFound,
+			"Unknown services: %s.",
+			strings.Join(unknown, ", "),
+		)
+	}
+	return svs, nil
+}
+
+// An environment for display, with the deployment in it at some time.
+type EnvironmentView struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// Nil if nothing was deployed at the time.
+	Deployment *Deployment `json:"deployment" yaml:"deployment"`
+}
+
+// Create a view of an environment as it was at a time, as it is now if the
+// time is zero.
+func NewEnvironmentView(e Environment, at time.Time) EnvironmentView {
+	ev := EnvironmentView{Name: e.Name, Description: e.Description}
+	d, ok := e.Current()
+	if !at.IsZero() {
+		d, ok = e.At(at)
+	}
+	if ok {
+		ev.Deployment = &d
+	}
+	return ev
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Create a unified diff of two texts with git. Empty if they are the same.
+func unifiedDiff(name1 string, name2 string, text1 string, text2 string) (string, error) {
+	if text1 == text2 {
+		return "", nil
+	}
+	dir, err := ioutil.TempDir("", "many-diff-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	p1 := filepath.Join(dir, "a")
+	p2 := filepath.Join(dir, "b")
+	err = ioutil.WriteFile(p1, []byte(text1), 0644)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(p2, []byte(text2), 0644)
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", "diff", "--no-index", "--no-color", "--unified=3", p1, p2)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	// git exits with 1 when the files differ.
+	var ee *exec.ExitError
+	if err != nil && !(errors.As(err, &ee) && ee.ExitCode() == 1) {
+		return "", fmt.Errorf("git diff: %s", strings.TrimSpace(stderr.String()))
+	}
+	// Replace git's headers, which name the temporary files.
+	out := stdout.String()
+	i := strings.Index(out, "\n@@")
+	if i < 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("--- %s\n+++ %s%s", name1, name2, out[i:]), nil
+}